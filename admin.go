@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxSignatureAge is how far an HMAC-signed request's timestamp may be from the current time
+const maxSignatureAge = 5 * time.Minute
+
+// headers of an HMAC-signed admin request
+const (
+	adminClientHeader    = "X-Attic-Client"
+	adminTimestampHeader = "X-Attic-Timestamp"
+	adminSignatureHeader = "X-Attic-Signature"
+)
+
+// adminClient is someone allowed to use the admin API. Requests are authenticated with the client's token as a
+// bearer token, or signed with its HMAC secret.
+type adminClient struct {
+	Name       string `yaml:"name"`
+	Token      string `yaml:"token"`
+	HMACSecret string `yaml:"hmac_secret"`
+}
+
+// adminAuth authenticates admin API requests and writes the audit log of who called what
+type adminAuth struct {
+	clients []adminClient
+	open    bool // no clients are configured and the admin API is only on the unix socket
+
+	lock sync.Mutex
+	seen map[string]time.Time // signatures already used, until they're too old to be accepted anyway
+}
+
+func newAdminAuth(cfg *Config) *adminAuth {
+	clients := cfg.adminClients()
+	return &adminAuth{
+		clients: clients,
+		open:    len(clients) == 0 && cfg.Admin.Socket != "",
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// wrap only lets authenticated requests through to the handler, and logs every request
+func (a *adminAuth) wrap(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := logrus.WithFields(logrus.Fields{
+			"remoteAddr": r.RemoteAddr,
+			"method":     r.Method,
+			"path":       r.URL.RequestURI(),
+		})
+
+		client, method, err := a.authenticate(r)
+		if err != nil {
+			log.WithError(err).Warn("Rejected admin request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="update-posts"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+
+		log.WithFields(logrus.Fields{
+			"audit":    true,
+			"client":   client,
+			"auth":     method,
+			"status":   recorder.status,
+			"duration": time.Since(start).String(),
+		}).Info("Admin request")
+	}
+}
+
+// authenticate returns the name of the client that sent the request and how it authenticated
+func (a *adminAuth) authenticate(r *http.Request) (string, string, error) {
+	if a.open {
+		return "unix socket", "socket", nil
+	}
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header {
+			return "", "", fmt.Errorf("unsupported authorization scheme")
+		}
+		for _, client := range a.clients {
+			if client.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(client.Token)) == 1 {
+				return client.Name, "bearer", nil
+			}
+		}
+		return "", "", fmt.Errorf("unknown bearer token")
+	}
+
+	if r.Header.Get(adminSignatureHeader) != "" {
+		name, err := a.verifySignature(r)
+		if err != nil {
+			return "", "", err
+		}
+		return name, "hmac", nil
+	}
+
+	return "", "", fmt.Errorf("missing credentials")
+}
+
+// verifySignature checks an HMAC-signed request. The signature is the hex HMAC-SHA256, keyed with the client's
+// secret, of the timestamp, method, request URI and body, each followed by a newline. Each signature is only
+// accepted once.
+func (a *adminAuth) verifySignature(r *http.Request) (string, error) {
+	name := r.Header.Get(adminClientHeader)
+	var client *adminClient
+	for i := range a.clients {
+		if a.clients[i].Name == name && a.clients[i].HMACSecret != "" {
+			client = &a.clients[i]
+			break
+		}
+	}
+	if client == nil {
+		return "", fmt.Errorf("unknown client '%s'", name)
+	}
+
+	timestamp := r.Header.Get(adminTimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if age := time.Since(signedAt); age > maxSignatureAge || age < -maxSignatureAge {
+		return "", fmt.Errorf("timestamp is %s off", age.Round(time.Second))
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return "", fmt.Errorf("Error reading request body: %s", err.Error())
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	signature, err := hex.DecodeString(r.Header.Get(adminSignatureHeader))
+	if err != nil {
+		return "", fmt.Errorf("signature isn't hex")
+	}
+	if !hmac.Equal(signature, signRequest(client.HMACSecret, timestamp, r.Method, r.URL.RequestURI(), body)) {
+		return "", fmt.Errorf("bad signature")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for seen, expires := range a.seen {
+		if time.Now().After(expires) {
+			delete(a.seen, seen)
+		}
+	}
+	key := hex.EncodeToString(signature)
+	if _, ok := a.seen[key]; ok {
+		return "", fmt.Errorf("signature was already used")
+	}
+	a.seen[key] = signedAt.Add(maxSignatureAge)
+
+	return client.Name, nil
+}
+
+func signRequest(secret string, timestamp string, method string, uri string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+	mac.Write([]byte("\n"))
+	return mac.Sum(nil)
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through, for handlers that stream their response
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**************************
+* separate admin listener *
+**************************/
+
+// startAdminListener serves the admin API on its own address or unix socket, in the background
+func startAdminListener(cfg *Config, handler http.Handler) *http.Server {
+	var listener net.Listener
+	var err error
+	if cfg.Admin.Socket != "" {
+		// a socket left behind by a previous run would make listening fail
+		if err := os.Remove(cfg.Admin.Socket); err != nil && !os.IsNotExist(err) {
+			logrus.WithError(err).Fatal("error removing old admin socket")
+		}
+		listener, err = net.Listen("unix", cfg.Admin.Socket)
+		if err == nil {
+			err = os.Chmod(cfg.Admin.Socket, 0660)
+		}
+	} else {
+		listener, err = net.Listen("tcp", cfg.Admin.ListenAddress)
+	}
+	if err != nil {
+		logrus.WithError(err).Fatal("error starting admin listener")
+	}
+	logrus.WithField("address", listener.Addr().String()).Info("Serving admin API")
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Fatal("error serving admin API")
+		}
+	}()
+	return server
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	watchModeFiles   = "files"
+	watchModeChanges = "changes"
+)
+
+// changeWatcher follows a source's changes feed with a single channel, so new authors, new posts and new images
+// are picked up without a restart. Posts it manages are keyed by their date folder's ID.
+type changeWatcher struct {
+	cfg     *Config
+	src     ChangeFeed
+	store   *stateStore
+	posts   *PostRegistry
+	updates *updateScheduler
+	rootID  string
+
+	// only used from the run goroutine once started
+	pageToken    string
+	folders      map[string]*FeedFile
+	rescanNeeded bool // an author or date folder was added, moved or removed
+
+	triggers chan struct{}
+	done     chan struct{} // closed to end run
+	finished chan struct{} // closed once run returns
+
+	lock       sync.Mutex
+	channel    *Channel
+	oldChannel *Channel // set while the channel is being renewed
+}
+
+// newChangeWatcher resumes from the saved page token, or starts from the source's current state if there is none
+func newChangeWatcher(cfg *Config, src ChangeFeed, store *stateStore) (*changeWatcher, error) {
+	rootID, err := src.RootFolderID()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := loadPageToken(cfg.Drive.PageTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token, err = src.StartPageToken()
+		if err != nil {
+			return nil, err
+		}
+		if err := savePageToken(cfg.Drive.PageTokenFile, token); err != nil {
+			return nil, err
+		}
+	}
+	logrus.WithField("pageToken", token).Info("Following Drive changes")
+
+	return &changeWatcher{
+		cfg:       cfg,
+		src:       src,
+		store:     store,
+		rootID:    rootID,
+		pageToken: token,
+		folders:   make(map[string]*FeedFile),
+		triggers:  make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		finished:  make(chan struct{}),
+	}, nil
+}
+
+// start opens the changes channel and begins processing notifications for the given posts
+func (w *changeWatcher) start(posts *PostRegistry, updates *updateScheduler) error {
+	w.posts = posts
+	w.updates = updates
+
+	channel, err := w.src.WatchChanges(w.pageToken)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	w.channel = channel
+	w.lock.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"channel id": channel.ID,
+		"expiration": channel.Expiration,
+	}).Info("Successfully subscribed to changes")
+
+	go w.run()
+	w.trigger() // catch up on anything that changed since the saved page token
+	return nil
+}
+
+// owns reports whether a notification's channel ID belongs to the changes feed
+func (w *changeWatcher) owns(id string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.channel != nil && id == w.channel.ID || w.oldChannel != nil && id == w.oldChannel.ID
+}
+
+// verify reports whether a notification to one of the feed's channels carries that channel's token and resource ID
+func (w *changeWatcher) verify(id string, token string, resourceID string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	channel := w.channel
+	if w.oldChannel != nil && id == w.oldChannel.ID {
+		channel = w.oldChannel
+	}
+	if channel == nil || id != channel.ID {
+		return false
+	}
+	return channel.verify(token, resourceID)
+}
+
+// trigger asks for the changes feed to be read. Triggers that arrive while the feed is being read are coalesced.
+func (w *changeWatcher) trigger() {
+	select {
+	case w.triggers <- struct{}{}:
+	default:
+		skipNotification(skipFeedCoalesced)
+	}
+}
+
+// expiration returns when the changes channel expires, or false if it isn't open
+func (w *changeWatcher) expiration() (time.Time, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.channel == nil {
+		return time.Time{}, false
+	}
+	return w.channel.Expiration, true
+}
+
+// stop closes the changes channel. It isn't renewed after that.
+func (w *changeWatcher) stop() error {
+	w.lock.Lock()
+	channel := w.channel
+	w.channel = nil
+	w.lock.Unlock()
+
+	if channel == nil {
+		return nil
+	}
+	return w.src.StopWatch(channel)
+}
+
+// run reads the changes feed when triggered, and renews the channel before it expires, until close is called
+func (w *changeWatcher) run() {
+	defer close(w.finished)
+
+	ticker := time.NewTicker(renewalCheckInterval(w.cfg))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.triggers:
+			if err := w.processChanges(); err != nil {
+				logrus.WithError(err).Error("Error processing Drive changes")
+			}
+		case <-ticker.C:
+			if err := w.renewIfExpiring(); err != nil {
+				logrus.WithError(err).Error("Failed to renew changes channel")
+			}
+		}
+	}
+}
+
+// close ends run, waiting for a read of the feed or a renewal under way. The watcher must have been started.
+func (w *changeWatcher) close() {
+	close(w.done)
+	<-w.finished
+}
+
+func (w *changeWatcher) renewIfExpiring() error {
+	w.lock.Lock()
+	oldChannel := w.channel
+	w.lock.Unlock()
+
+	if oldChannel == nil { // stopped
+		return nil
+	}
+	if !oldChannel.expiresBefore(time.Now().Add(w.cfg.Drive.ChannelRenewBefore)) {
+		return nil
+	}
+
+	newChannel, err := w.src.WatchChanges(w.pageToken)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	if w.channel == nil { // stopped while the new channel was opened
+		w.lock.Unlock()
+		return w.src.StopWatch(newChannel)
+	}
+	w.channel = newChannel
+	w.oldChannel = oldChannel
+	w.lock.Unlock()
+
+	log := logrus.WithFields(logrus.Fields{
+		"old channel id": oldChannel.ID,
+		"new channel id": newChannel.ID,
+		"expiration":     newChannel.Expiration,
+	})
+
+	if err := w.src.StopWatch(oldChannel); err != nil {
+		log.WithError(err).Warn("Error stopping old changes channel after renewal")
+	}
+
+	w.lock.Lock()
+	w.oldChannel = nil
+	w.lock.Unlock()
+
+	log.Info("Renewed changes channel")
+	return nil
+}
+
+/**********************
+* process the changes *
+**********************/
+
+// processChanges reads the changes feed from the saved page token to the end, saving the token after each page
+func (w *changeWatcher) processChanges() error {
+	for {
+		r, err := w.src.ListChanges(w.pageToken)
+		if err != nil {
+			return err
+		}
+
+		for _, change := range r.Changes {
+			w.applyChange(change)
+		}
+
+		if r.NextPageToken != "" {
+			w.pageToken = r.NextPageToken
+		} else {
+			w.pageToken = r.NewStartPageToken
+		}
+		if err := savePageToken(w.cfg.Drive.PageTokenFile, w.pageToken); err != nil {
+			return err
+		}
+
+		if r.NextPageToken == "" {
+			break
+		}
+	}
+
+	// posts in folders that were moved or removed are picked up or dropped by walking the tree again
+	if w.rescanNeeded {
+		w.rescanNeeded = false
+		result, err := rescanPosts(w.cfg, w.src, w.store, w.posts, w.updates)
+		if err != nil {
+			return fmt.Errorf("Error rescanning posts after folder changes: %s", err.Error())
+		}
+		logrus.WithFields(logrus.Fields{
+			"added":   len(result.Added),
+			"removed": len(result.Removed),
+		}).Info("Rescanned posts after folder changes")
+	}
+	return nil
+}
+
+// applyChange maps a changed file back to the post it belongs to, creating the post if it's new
+func (w *changeWatcher) applyChange(change FeedChange) {
+	log := logrus.WithField("fileID", change.FileID)
+
+	if change.Removed || change.File == nil || change.File.Trashed {
+		if change.File != nil && change.File.MimeType == folderMime {
+			w.folders[change.FileID] = change.File // a trashed folder keeps its parents
+		}
+		w.removeFile(change.FileID)
+		return
+	}
+
+	file := change.File
+	isPost := file.MimeType == docxMime || file.MimeType == googleDocMime
+	isImage := isImageMime(file.MimeType)
+	if file.MimeType == folderMime {
+		wasInTree := w.inTree(file.ID) || w.posts.inFolder(file.ID) != nil
+		w.folders[file.ID] = file // keep renamed or moved folders up to date
+		if wasInTree || w.inTree(file.ID) {
+			w.rescanNeeded = true
+		}
+		return
+	}
+	if !isPost && !isImage || len(file.Parents) == 0 {
+		return
+	}
+
+	author, date, err := w.resolvePostFolder(file.Parents[0])
+	if err != nil {
+		log.WithError(err).Error("Error resolving folder of changed file")
+		return
+	}
+	if date == nil { // not inside a post folder
+		return
+	}
+
+	post, ok := w.posts.get(date.ID)
+
+	if !ok {
+		post, err = loadPost(w.src, author, date.SourceFile)
+		if err != nil {
+			log.WithError(err).Error("Error loading new post")
+			return
+		}
+		if post == nil { // not complete yet; a later change will add it
+			return
+		}
+
+		if !subscribePost(w.cfg, w.src, w.store, w.posts, post) { // found by a rescan in the meantime
+			return
+		}
+		log.WithField("post", post).Info("Found new post")
+	} else {
+		// an added image may change which one is the cover, and an added document may leave the folder with two, so
+		// the whole folder is listed again
+		if !w.reload(post) {
+			return
+		}
+	}
+
+	log.WithField("post", post).Debug("Received change for post")
+	w.updates.schedule(post)
+}
+
+// removeFile drops the post whose document or folder was removed from Drive. Its html is left in place. If the file
+// was one of a post's images, the post is rebuilt without it, and if it was an author folder, its posts are dropped
+// by a rescan.
+func (w *changeWatcher) removeFile(fileID string) {
+	if _, ok := w.folders[fileID]; ok && w.inTree(fileID) {
+		w.rescanNeeded = true
+	}
+	delete(w.folders, fileID)
+	for _, post := range w.posts.removeFile(fileID) {
+		if err := w.store.removePost(post.FolderID); err != nil {
+			logrus.WithError(err).WithField("post", post).Error("Error removing saved post")
+		}
+		logrus.WithField("post", post).Warn("Post was removed from Drive, no longer tracking it")
+	}
+
+	if post := w.posts.withImage(fileID); post != nil && w.reload(post) {
+		w.updates.schedule(post)
+	}
+}
+
+// reload lists a changed post's folder again, and stops tracking the post if the folder no longer holds one. It
+// reports whether the post is still tracked.
+func (w *changeWatcher) reload(post *Post) bool {
+	err := reloadPost(w.cfg, w.src, w.posts, post, nil)
+	if err == errIncompletePost {
+		forgetPost(w.src, w.store, w.posts, post)
+		return false
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("post", post).Error("Error reloading changed post")
+		return false
+	}
+	return true
+}
+
+// resolvePostFolder checks whether a folder is an author's date folder, and if so returns the author's name and the
+// folder. A nil folder means the folder holds no post.
+func (w *changeWatcher) resolvePostFolder(folderID string) (string, *FeedFile, error) {
+	date, err := w.folder(folderID)
+	if err != nil || date.MimeType != folderMime || len(date.Parents) == 0 {
+		return "", nil, err
+	}
+
+	author, err := w.folder(date.Parents[0])
+	if err != nil || author.MimeType != folderMime || len(author.Parents) == 0 || author.Parents[0] != w.rootID {
+		return "", nil, err
+	}
+	if !validFolderName(author.Name) || !validFolderName(date.Name) {
+		logrus.WithFields(logrus.Fields{
+			"author": author.Name,
+			"date":   date.Name,
+		}).Warn("Ignoring post folder with an invalid name")
+		return "", nil, nil
+	}
+
+	return author.Name, date, nil
+}
+
+// inTree reports whether a folder is an author or date folder, as far as the folders seen so far tell
+func (w *changeWatcher) inTree(folderID string) bool {
+	folder, err := w.folder(folderID)
+	if err != nil || folder.MimeType != folderMime || len(folder.Parents) == 0 {
+		return false
+	}
+	if folder.Parents[0] == w.rootID {
+		return true
+	}
+	author, err := w.folder(folder.Parents[0])
+	return err == nil && len(author.Parents) > 0 && author.Parents[0] == w.rootID
+}
+
+// folder returns a folder's metadata, fetching it from the source on first use
+func (w *changeWatcher) folder(id string) (*FeedFile, error) {
+	if folder, ok := w.folders[id]; ok {
+		return folder, nil
+	}
+
+	folder, err := w.src.GetFolder(id)
+	if err != nil {
+		return nil, err
+	}
+	w.folders[id] = folder
+	return folder, nil
+}
+
+/*************************
+* page token persistence *
+*************************/
+
+// loadPageToken returns the saved page token, or an empty string if none has been saved yet
+func loadPageToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error reading page token file: %s", err.Error())
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// savePageToken replaces the saved page token, writing it to a temporary file first so a crash can't truncate it
+func savePageToken(path string, token string) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(token+"\n"), 0600); err != nil {
+		return fmt.Errorf("Error writing page token file: %s", err.Error())
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Error replacing page token file: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"image/color"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestChangeWatcher subscribes to the posts in src and follows its changes from there. process reads the changes
+// feed and returns the posts it scheduled to be built.
+func newTestChangeWatcher(t *testing.T, src *memorySource) (w *changeWatcher, process func() []string) {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.Drive.WatchMode = watchModeChanges
+	cfg.Drive.PageTokenFile = filepath.Join(tempDir(t), "page-token")
+	cfg.Debounce.QuietPeriod = time.Hour
+	cfg.Debounce.MaxWait = time.Hour
+
+	posts, err := subscribeToPosts(cfg, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = newChangeWatcher(cfg, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.posts = posts
+
+	process = func() []string {
+		t.Helper()
+
+		w.updates = newUpdateScheduler(cfg, func(post *Post) {})
+		defer w.updates.stop()
+		if err := w.processChanges(); err != nil {
+			t.Fatal(err)
+		}
+		var scheduled []string
+		for _, pending := range w.updates.pendingPosts() {
+			scheduled = append(scheduled, pending.Author+"/"+pending.Date)
+		}
+		sort.Strings(scheduled)
+		return scheduled
+	}
+	return w, process
+}
+
+func TestChangeWatcher(t *testing.T) {
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+	w, process := newTestChangeWatcher(t, src)
+	posts := w.posts
+
+	gallery := func(post *Post) []string {
+		var names []string
+		for _, image := range posts.snapshot(post).gallery {
+			names = append(names, image.Name)
+		}
+		return names
+	}
+
+	// a new post is tracked by its folder and built
+	putTestPost(t, src, "bob", "2021-02-03")
+	if scheduled := process(); !equalRows(scheduled, []string{"bob/2021-02-03"}) {
+		t.Errorf("scheduled %v, want [bob/2021-02-03]", scheduled)
+	}
+	bob, ok := posts.get("bob/2021-02-03")
+	if !ok {
+		t.Fatal("new post isn't tracked")
+	}
+
+	// added and removed images are picked up
+	alice := posts.find("alice", "2021-01-02")
+	src.PutImage("alice", "2021-01-02", "sunset.png", testImage(t, color.Black))
+	if scheduled := process(); !equalRows(scheduled, []string{"alice/2021-01-02"}) {
+		t.Errorf("scheduled %v after adding an image", scheduled)
+	}
+	if names := gallery(alice); !equalRows(names, []string{"beach.png", "sunset.png"}) {
+		t.Errorf("gallery is %v after adding an image", names)
+	}
+	src.Remove("alice/2021-01-02/beach.png")
+	if scheduled := process(); !equalRows(scheduled, []string{"alice/2021-01-02"}) {
+		t.Errorf("scheduled %v after removing an image", scheduled)
+	}
+	if names := gallery(alice); !equalRows(names, []string{"sunset.png"}) {
+		t.Errorf("gallery is %v after removing an image", names)
+	}
+
+	// an edited document is built again
+	edited := src.PutDocument("alice", "2021-01-02", "My Post.docx", testDocument(t, "Edited by alice"))
+	if scheduled := process(); !equalRows(scheduled, []string{"alice/2021-01-02"}) {
+		t.Errorf("scheduled %v after editing the document", scheduled)
+	}
+	if checksum := posts.snapshot(alice).checksum; checksum != edited.Checksum {
+		t.Errorf("checksum is %s, want %s", checksum, edited.Checksum)
+	}
+
+	// a post whose document is removed is no longer tracked
+	src.Remove("bob/2021-02-03/My Post.docx")
+	if scheduled := process(); len(scheduled) != 0 {
+		t.Errorf("scheduled %v after removing a document", scheduled)
+	}
+	if _, ok := posts.get(bob.FolderID); ok {
+		t.Error("post is still tracked after its document was removed")
+	}
+
+	// a removed author folder drops its posts through a rescan
+	src.Remove("alice")
+	process()
+	if posts.len() != 0 {
+		t.Errorf("%d posts tracked after every post was removed", posts.len())
+	}
+
+	token, err := loadPageToken(w.cfg.Drive.PageTokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end, _ := src.StartPageToken(); token != end {
+		t.Errorf("saved page token is %s, want %s", token, end)
+	}
+}
+
+func TestChangeWatcherSecondDocument(t *testing.T) {
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+	w, process := newTestChangeWatcher(t, src)
+	post := w.posts.find("alice", "2021-01-02")
+
+	// a second draft doesn't replace the published document; the folder is no longer a post
+	src.PutDocument("alice", "2021-01-02", "Draft.docx", testDocument(t, "draft"))
+	if scheduled := process(); len(scheduled) != 0 {
+		t.Errorf("scheduled %v after adding a second document", scheduled)
+	}
+	if w.posts.find("alice", "2021-01-02") != nil {
+		t.Error("post is still tracked with two documents")
+	}
+	if post.FileName != "My Post.docx" {
+		t.Errorf("document switched to %s", post.FileName)
+	}
+}
+
+func TestChangeWatcherClose(t *testing.T) {
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+	w, _ := newTestChangeWatcher(t, src)
+	updates := newUpdateScheduler(w.cfg, func(post *Post) {})
+	defer updates.stop()
+	if err := w.start(w.posts, updates); err != nil {
+		t.Fatal(err)
+	}
+	if channels := src.WatchingChannels("changes"); len(channels) != 1 {
+		t.Fatalf("%d channels on the changes feed, want 1", len(channels))
+	}
+
+	// run returns once closed, and the channel is stopped after that, as on shutdown
+	w.close()
+	if err := w.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if channels := src.WatchingChannels("changes"); len(channels) != 0 {
+		t.Errorf("%d channels still on the changes feed", len(channels))
+	}
+}
+
+func TestResolvePostFolderRejectsInvalidNames(t *testing.T) {
+	w, _ := newTestChangeWatcher(t, newMemorySource())
+	folder := func(id string, name string, parent string) {
+		w.folders[id] = &FeedFile{SourceFile: SourceFile{ID: id, Name: name, MimeType: folderMime}, Parents: []string{parent}}
+	}
+	folder("alice", "alice", w.rootID)
+	folder("escaping", "../bob", w.rootID)
+	folder("alice/date", "2021-01-02", "alice")
+	folder("alice/parent", "..", "alice")
+	folder("escaping/date", "2021-01-02", "escaping")
+
+	tests := []struct {
+		folderID string
+		author   string
+	}{
+		{"alice/date", "alice"},
+		{"alice/parent", ""},
+		{"escaping/date", ""},
+	}
+	for _, test := range tests {
+		author, date, err := w.resolvePostFolder(test.folderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if author != test.author || (date != nil) != (test.author != "") {
+			t.Errorf("%s: resolved to author %q and folder %v, want author %q", test.folderID, author, date, test.author)
+		}
+	}
+}
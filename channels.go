@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Drive refuses file watch channels that live longer than a day
+const maxChannelTTL = 24 * time.Hour
+
+// channelManager renews the watch channel of every post before Drive expires it
+type channelManager struct {
+	cfg   *Config
+	src   Source
+	store *stateStore
+	posts *PostRegistry
+
+	done     chan struct{} // closed to end run
+	finished chan struct{} // closed once run returns
+}
+
+func newChannelManager(cfg *Config, src Source, store *stateStore, posts *PostRegistry) *channelManager {
+	return &channelManager{
+		cfg:      cfg,
+		src:      src,
+		store:    store,
+		posts:    posts,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// renewalCheckInterval is how often channels are checked for expiry, often enough that every channel is looked at
+// at least twice inside its renewal window
+func renewalCheckInterval(cfg *Config) time.Duration {
+	interval := cfg.Drive.ChannelRenewBefore / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// run checks for expiring channels until close is called
+func (m *channelManager) run() {
+	defer close(m.finished)
+
+	interval := renewalCheckInterval(m.cfg)
+	logrus.WithField("interval", interval).Info("Starting channel manager")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.renewExpiring()
+		}
+	}
+}
+
+// close ends run, waiting for any renewals under way. run must have been started.
+func (m *channelManager) close() {
+	close(m.done)
+	<-m.finished
+}
+
+// renewExpiring renews every channel that expires within the configured renewal window
+func (m *channelManager) renewExpiring() {
+	deadline := time.Now().Add(m.cfg.Drive.ChannelRenewBefore)
+
+	for _, post := range m.posts.expiring(deadline) {
+		if err := m.renew(post); err != nil {
+			// the old channel is kept, so the next check tries again
+			logrus.WithError(err).WithField("post", post).Error("Failed to renew channel for post")
+		}
+	}
+}
+
+// renew opens a replacement channel for the post and only then stops the old one. Both channel IDs map to the post
+// while the swap happens so notifications sent to either are handled.
+func (m *channelManager) renew(post *Post) error {
+	snapshot := m.posts.snapshot(post)
+	newChannel, err := m.src.Watch(snapshot.document())
+	if err != nil {
+		return err
+	}
+
+	oldChannel := m.posts.swapChannel(post, newChannel)
+	if oldChannel == nil { // stopped while the new channel was opened
+		return m.src.StopWatch(newChannel)
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"old channel id": oldChannel.ID,
+		"new channel id": newChannel.ID,
+		"expiration":     newChannel.Expiration,
+	})
+
+	if err := m.store.saveChannel(post.FolderID, newChannel); err != nil {
+		log.WithError(err).Error("Error saving renewed channel")
+	}
+
+	if err := m.src.StopWatch(oldChannel); err != nil {
+		// the old channel expires on its own soon anyway
+		log.WithError(err).Warn("Error stopping old channel after renewal")
+	}
+
+	m.posts.dropOldChannel(post, oldChannel)
+
+	log.Info("Renewed channel for post")
+	return nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds everything that used to be hardcoded for a single machine. Values are layered, from lowest to
+// highest precedence: defaults, the YAML config file, ATTIC_* environment variables, then command line flags.
+type Config struct {
+	CredentialsFile string `yaml:"credentials_file"`
+	TokenFile       string `yaml:"token_file"`
+	ListenAddress   string `yaml:"listen_address"`
+	WebhookAddress  string `yaml:"webhook_address"`
+	Source          string `yaml:"source"`
+	StateFile       string `yaml:"state_file"`
+
+	Drive struct {
+		RootFolder         string        `yaml:"root_folder"`
+		DownloadDir        string        `yaml:"download_dir"`
+		WatchMode          string        `yaml:"watch_mode"`
+		PageTokenFile      string        `yaml:"page_token_file"`
+		RescanInterval     time.Duration `yaml:"rescan_interval"`
+		PageSize           int           `yaml:"page_size"`
+		ChannelTTL         time.Duration `yaml:"channel_ttl"`
+		ChannelRenewBefore time.Duration `yaml:"channel_renew_before"`
+	} `yaml:"drive"`
+
+	Admin struct {
+		ListenAddress string        `yaml:"listen_address"`
+		Socket        string        `yaml:"socket"`
+		Token         string        `yaml:"token"`
+		HMACSecret    string        `yaml:"hmac_secret"`
+		Clients       []adminClient `yaml:"clients"`
+	} `yaml:"admin"`
+
+	Build struct {
+		Workers int `yaml:"workers"`
+	} `yaml:"build"`
+
+	Shutdown struct {
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"shutdown"`
+
+	Debounce struct {
+		QuietPeriod time.Duration `yaml:"quiet_period"`
+		MaxWait     time.Duration `yaml:"max_wait"`
+	} `yaml:"debounce"`
+
+	Local struct {
+		RootDir string `yaml:"root_dir"`
+	} `yaml:"local"`
+
+	HTML struct {
+		OutputDir string `yaml:"output_dir"`
+		PostsDir  string `yaml:"posts_dir"`
+	} `yaml:"html"`
+
+	Convert struct {
+		Converter  string `yaml:"converter"`
+		Template   string `yaml:"template"`
+		OutputFile string `yaml:"output_file"`
+	} `yaml:"convert"`
+
+	Thumbnail struct {
+		Generator string          `yaml:"generator"`
+		Sizes     []thumbnailSize `yaml:"sizes"`
+		Overlay   bool            `yaml:"overlay"`
+		Quality   int             `yaml:"quality"`
+	} `yaml:"thumbnail"`
+
+	Homepage struct {
+		Generator   string `yaml:"generator"`
+		TemplateDir string `yaml:"template_dir"`
+		PageSize    int    `yaml:"page_size"`
+	} `yaml:"homepage"`
+
+	Scripts struct {
+		Convert   string `yaml:"convert"`
+		Thumbnail string `yaml:"thumbnail"`
+		Homepage  string `yaml:"homepage"`
+		HEIC      string `yaml:"heic"`
+	} `yaml:"scripts"`
+
+	Deploy struct {
+		Method   string `yaml:"method"`
+		Sudo     string `yaml:"sudo"`
+		Rsync    string `yaml:"rsync"`
+		Target   string `yaml:"target"`
+		Contents bool   `yaml:"contents"`
+
+		S3 struct {
+			Endpoint  string `yaml:"endpoint"`
+			Bucket    string `yaml:"bucket"`
+			Prefix    string `yaml:"prefix"`
+			Region    string `yaml:"region"`
+			AccessKey string `yaml:"access_key"`
+			SecretKey string `yaml:"secret_key"`
+			Insecure  bool   `yaml:"insecure"`
+		} `yaml:"s3"`
+	} `yaml:"deploy"`
+}
+
+const configEnvPrefix = "ATTIC_"
+
+func defaultConfig() *Config {
+	cfg := new(Config)
+	cfg.CredentialsFile = "credentials.json"
+	cfg.TokenFile = "token.json"
+	cfg.ListenAddress = ":9000"
+	cfg.Source = sourceDrive
+	cfg.StateFile = "state.db"
+	cfg.Drive.RootFolder = "attic-posts"
+	cfg.Drive.WatchMode = watchModeFiles
+	cfg.Drive.PageTokenFile = "page_token"
+	cfg.Drive.RescanInterval = 15 * time.Minute
+	cfg.Drive.PageSize = 100
+	cfg.Drive.ChannelTTL = time.Hour
+	cfg.Drive.ChannelRenewBefore = 5 * time.Minute
+	cfg.Build.Workers = 2
+	cfg.Shutdown.Timeout = 30 * time.Second
+	cfg.Debounce.QuietPeriod = 30 * time.Second
+	cfg.Debounce.MaxWait = 5 * time.Minute
+	cfg.HTML.PostsDir = "posts"
+	cfg.Convert.OutputFile = "index.html"
+	cfg.Thumbnail.Sizes = []thumbnailSize{{Name: "thumbnail", Width: 480, Height: 320}}
+	cfg.Thumbnail.Quality = 85
+	cfg.Homepage.PageSize = 20
+	cfg.Scripts.HEIC = "heif-convert"
+	cfg.Deploy.Method = deployRsync
+	cfg.Deploy.Rsync = "rsync"
+	return cfg
+}
+
+// configOption ties a config field to its flag and environment variable. The environment variable name is the
+// flag name upper-cased, with dashes and dots replaced by underscores, and prefixed with ATTIC_.
+type configOption struct {
+	name     string
+	usage    string
+	required bool
+	value    func(cfg *Config) flag.Value
+}
+
+func configOptions() []configOption {
+	return []configOption{
+		{"source", "where posts are read from: 'drive' or 'local'", true, stringField(func(c *Config) *string { return &c.Source })},
+		{"credentials-file", "path to the Google OAuth client secret file", false, stringField(func(c *Config) *string { return &c.CredentialsFile })},
+		{"token-file", "path to the cached Google OAuth token", false, stringField(func(c *Config) *string { return &c.TokenFile })},
+		{"listen-address", "address for the http listener", true, stringField(func(c *Config) *string { return &c.ListenAddress })},
+		{"webhook-address", "public URL Google Drive sends notifications to", false, stringField(func(c *Config) *string { return &c.WebhookAddress })},
+		{"state-file", "file posts, channels and build results are saved in across restarts; empty to save nothing", false, stringField(func(c *Config) *string { return &c.StateFile })},
+		{"drive.root-folder", "name of the Google Drive folder holding all posts", false, stringField(func(c *Config) *string { return &c.Drive.RootFolder })},
+		{"drive.download-dir", "directory posts are downloaded into", true, stringField(func(c *Config) *string { return &c.Drive.DownloadDir })},
+		{"drive.watch-mode", "how Drive is watched: 'files' (one channel per post) or 'changes' (the whole folder tree)", true, stringField(func(c *Config) *string { return &c.Drive.WatchMode })},
+		{"drive.page-token-file", "where the changes feed page token is saved in 'changes' watch mode", true, stringField(func(c *Config) *string { return &c.Drive.PageTokenFile })},
+		{"drive.rescan-interval", "how often the folder tree is rescanned for new posts, 0 to disable", false, durationField(func(c *Config) *time.Duration { return &c.Drive.RescanInterval })},
+		{"drive.page-size", "number of results requested per page when listing Drive files and changes (1-1000)", false, intField(func(c *Config) *int { return &c.Drive.PageSize })},
+		{"drive.channel-ttl", "lifetime requested for each Drive watch channel", false, durationField(func(c *Config) *time.Duration { return &c.Drive.ChannelTTL })},
+		{"drive.channel-renew-before", "how long before expiry a watch channel is renewed", false, durationField(func(c *Config) *time.Duration { return &c.Drive.ChannelRenewBefore })},
+		{"admin.listen-address", "optional separate host:port for the admin API, instead of listen-address", false, stringField(func(c *Config) *string { return &c.Admin.ListenAddress })},
+		{"admin.socket", "optional unix socket for the admin API, instead of listen-address", false, stringField(func(c *Config) *string { return &c.Admin.Socket })},
+		{"admin.token", "bearer token of the admin API client named 'admin'", false, stringField(func(c *Config) *string { return &c.Admin.Token })},
+		{"admin.hmac-secret", "HMAC secret of the admin API client named 'admin'", false, stringField(func(c *Config) *string { return &c.Admin.HMACSecret })},
+		{"build.workers", "number of posts built at the same time", false, intField(func(c *Config) *int { return &c.Build.Workers })},
+		{"shutdown.timeout", "how long shutdown waits for running builds and the deploy after them", false, durationField(func(c *Config) *time.Duration { return &c.Shutdown.Timeout })},
+		{"debounce.quiet-period", "how long a post must go without changes before it's built", false, durationField(func(c *Config) *time.Duration { return &c.Debounce.QuietPeriod })},
+		{"debounce.max-wait", "longest a changed post waits to be built while it keeps changing", false, durationField(func(c *Config) *time.Duration { return &c.Debounce.MaxWait })},
+		{"local.root-dir", "local directory holding all posts, laid out like the Drive folder, when source is 'local'", false, stringField(func(c *Config) *string { return &c.Local.RootDir })},
+		{"html.output-dir", "root directory of the generated website", true, stringField(func(c *Config) *string { return &c.HTML.OutputDir })},
+		{"html.posts-dir", "post html directory, relative to html.output-dir", true, stringField(func(c *Config) *string { return &c.HTML.PostsDir })},
+		{"convert.converter", "how posts are converted to html: 'native' or 'script'; defaults to 'script' if scripts.convert is set, else 'native'", true, stringField(func(c *Config) *string { return &c.Convert.Converter })},
+		{"convert.template", "optional html/template file for post pages, used by the native converter", false, stringField(func(c *Config) *string { return &c.Convert.Template })},
+		{"convert.output-file", "file name of a post's page in its html directory, used by the native converter", true, stringField(func(c *Config) *string { return &c.Convert.OutputFile })},
+		{"thumbnail.generator", "how thumbnails are created: 'native' or 'script'; defaults to 'script' if scripts.thumbnail is set, else 'native'", true, stringField(func(c *Config) *string { return &c.Thumbnail.Generator })},
+		{"thumbnail.overlay", "write the post's title and author over native thumbnails", false, boolField(func(c *Config) *bool { return &c.Thumbnail.Overlay })},
+		{"thumbnail.quality", "jpeg quality of native thumbnails (1-100)", false, intField(func(c *Config) *int { return &c.Thumbnail.Quality })},
+		{"homepage.generator", "how the homepage is generated: 'native' or 'script'; defaults to 'script' if scripts.homepage is set, else 'native'", true, stringField(func(c *Config) *string { return &c.Homepage.Generator })},
+		{"homepage.template-dir", "optional directory of html/template files for the native homepage, with index.html as the page template", false, stringField(func(c *Config) *string { return &c.Homepage.TemplateDir })},
+		{"homepage.page-size", "posts per homepage page, 0 for a single page", false, intField(func(c *Config) *int { return &c.Homepage.PageSize })},
+		{"scripts.convert", "script converting a post docx to html; the native converter's fallback", false, stringField(func(c *Config) *string { return &c.Scripts.Convert })},
+		{"scripts.thumbnail", "script creating thumbnails from a cover image; the native generator's fallback", false, stringField(func(c *Config) *string { return &c.Scripts.Thumbnail })},
+		{"scripts.homepage", "script regenerating the homepage; the native generator's fallback", false, stringField(func(c *Config) *string { return &c.Scripts.Homepage })},
+		{"scripts.heic", "command converting a HEIC or HEIF image to jpeg, run as '<command> <image> <jpeg>'", false, stringField(func(c *Config) *string { return &c.Scripts.HEIC })},
+		{"deploy.method", "how the website is deployed: 'local' (copy to a directory), 'rsync' or 's3'", true, stringField(func(c *Config) *string { return &c.Deploy.Method })},
+		{"deploy.sudo", "optional sudo binary to run rsync with", false, stringField(func(c *Config) *string { return &c.Deploy.Sudo })},
+		{"deploy.rsync", "rsync binary used to deploy the website", false, stringField(func(c *Config) *string { return &c.Deploy.Rsync })},
+		{"deploy.target", "directory (or rsync destination) the website is deployed to, for the 'local' and 'rsync' methods", false, stringField(func(c *Config) *string { return &c.Deploy.Target })},
+		{"deploy.contents", "deploy the contents of html.output-dir into deploy.target, instead of the directory itself", false, boolField(func(c *Config) *bool { return &c.Deploy.Contents })},
+		{"deploy.s3.endpoint", "host[:port] of the S3-compatible object store", false, stringField(func(c *Config) *string { return &c.Deploy.S3.Endpoint })},
+		{"deploy.s3.bucket", "bucket the website is uploaded to", false, stringField(func(c *Config) *string { return &c.Deploy.S3.Bucket })},
+		{"deploy.s3.prefix", "optional key prefix the website is uploaded under", false, stringField(func(c *Config) *string { return &c.Deploy.S3.Prefix })},
+		{"deploy.s3.region", "optional bucket region", false, stringField(func(c *Config) *string { return &c.Deploy.S3.Region })},
+		{"deploy.s3.access-key", "object store access key", false, stringField(func(c *Config) *string { return &c.Deploy.S3.AccessKey })},
+		{"deploy.s3.secret-key", "object store secret key", false, stringField(func(c *Config) *string { return &c.Deploy.S3.SecretKey })},
+		{"deploy.s3.insecure", "connect to the object store over plain http, e.g. a local MinIO", false, boolField(func(c *Config) *bool { return &c.Deploy.S3.Insecure })},
+	}
+}
+
+func (o configOption) envName() string {
+	return configEnvPrefix + strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(o.name))
+}
+
+// loadConfig builds the configuration from defaults, the config file, the environment and the given command line
+// arguments (without the program name), then validates it.
+func loadConfig(args []string) (*Config, error) {
+	options := configOptions()
+
+	// parse flags into a scratch config so they can be applied last, after the file and environment
+	scratch := defaultConfig()
+	fs := flag.NewFlagSet("update-posts", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to the YAML config file (env "+configEnvPrefix+"CONFIG)")
+	for _, option := range options {
+		fs.Var(option.value(scratch), option.name, fmt.Sprintf("%s (env %s)", option.usage, option.envName()))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	setFlags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	cfg := defaultConfig()
+
+	/***********************
+	* load the config file *
+	***********************/
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading config file: %s", err.Error())
+		}
+		if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+			return nil, fmt.Errorf("Error parsing config file '%s': %s", path, err.Error())
+		}
+		logrus.WithField("path", path).Info("Loaded config file")
+	}
+
+	/************************************
+	* apply environment and flag values *
+	************************************/
+
+	for _, option := range options {
+		if value, ok := os.LookupEnv(option.envName()); ok {
+			if err := option.value(cfg).Set(value); err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %s", option.envName(), err.Error())
+			}
+		}
+	}
+	for _, option := range options {
+		if value, ok := setFlags[option.name]; ok {
+			option.value(cfg).Set(value) // already validated when parsing the flags
+		}
+	}
+
+	cfg.defaultGenerators()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// defaultGenerators picks the converter and generators that weren't configured: the script when its scripts.* value
+// is set, so configs written before the native generators existed keep running their scripts, and native otherwise
+func (cfg *Config) defaultGenerators() {
+	if cfg.Convert.Converter == "" {
+		cfg.Convert.Converter = converterNative
+		if cfg.Scripts.Convert != "" {
+			cfg.Convert.Converter = converterScript
+		}
+	}
+	if cfg.Thumbnail.Generator == "" {
+		cfg.Thumbnail.Generator = thumbnailerNative
+		if cfg.Scripts.Thumbnail != "" {
+			cfg.Thumbnail.Generator = thumbnailerScript
+		}
+	}
+	if cfg.Homepage.Generator == "" {
+		cfg.Homepage.Generator = homepageNative
+		if cfg.Scripts.Homepage != "" {
+			cfg.Homepage.Generator = homepageScript
+		}
+	}
+}
+
+// validate checks that every required setting is present and well formed
+func (cfg *Config) validate() error {
+	var missing []string
+	for _, option := range configOptions() {
+		if option.required && strings.TrimSpace(option.value(cfg).String()) == "" {
+			missing = append(missing, option.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing required config values: %s", strings.Join(missing, ", "))
+	}
+
+	switch cfg.Source {
+	case sourceDrive:
+		for _, option := range configOptions() {
+			switch option.name {
+			case "credentials-file", "token-file", "webhook-address", "drive.root-folder":
+				if strings.TrimSpace(option.value(cfg).String()) == "" {
+					missing = append(missing, option.name)
+				}
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("Missing config values required when source is '%s': %s", sourceDrive, strings.Join(missing, ", "))
+		}
+		if !strings.HasPrefix(cfg.WebhookAddress, "https://") {
+			return fmt.Errorf("webhook-address must be an https URL, got '%s'", cfg.WebhookAddress)
+		}
+	case sourceLocal:
+		if cfg.Local.RootDir == "" {
+			return fmt.Errorf("local.root-dir is required when source is '%s'", sourceLocal)
+		}
+	default:
+		return fmt.Errorf("source must be '%s' or '%s', got '%s'", sourceDrive, sourceLocal, cfg.Source)
+	}
+	if _, port, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		return fmt.Errorf("listen-address must be of the form host:port: %s", err.Error())
+	} else if _, err := strconv.Atoi(port); err != nil {
+		return fmt.Errorf("listen-address has an invalid port '%s'", port)
+	}
+	if cfg.Convert.Converter != converterNative && cfg.Convert.Converter != converterScript {
+		return fmt.Errorf("convert.converter must be '%s' or '%s', got '%s'", converterNative, converterScript, cfg.Convert.Converter)
+	}
+	if cfg.Convert.Converter == converterScript && cfg.Scripts.Convert == "" {
+		return fmt.Errorf("scripts.convert is required when convert.converter is '%s'", converterScript)
+	}
+	if cfg.Thumbnail.Generator != thumbnailerNative && cfg.Thumbnail.Generator != thumbnailerScript {
+		return fmt.Errorf("thumbnail.generator must be '%s' or '%s', got '%s'", thumbnailerNative, thumbnailerScript, cfg.Thumbnail.Generator)
+	}
+	if cfg.Thumbnail.Generator == thumbnailerScript && cfg.Scripts.Thumbnail == "" {
+		return fmt.Errorf("scripts.thumbnail is required when thumbnail.generator is '%s'", thumbnailerScript)
+	}
+	if len(cfg.Thumbnail.Sizes) == 0 {
+		return fmt.Errorf("thumbnail.sizes needs at least one size")
+	}
+	for _, size := range cfg.Thumbnail.Sizes {
+		if size.Name == "" || strings.ContainsAny(size.Name, `/\`) || size.Width <= 0 || size.Height <= 0 {
+			return fmt.Errorf("thumbnail.sizes entries need a plain file name and a positive width and height, got %+v", size)
+		}
+	}
+	if cfg.Thumbnail.Quality < 1 || cfg.Thumbnail.Quality > 100 {
+		return fmt.Errorf("thumbnail.quality must be between 1 and 100, got %d", cfg.Thumbnail.Quality)
+	}
+	if cfg.Homepage.Generator != homepageNative && cfg.Homepage.Generator != homepageScript {
+		return fmt.Errorf("homepage.generator must be '%s' or '%s', got '%s'", homepageNative, homepageScript, cfg.Homepage.Generator)
+	}
+	if cfg.Homepage.Generator == homepageScript && cfg.Scripts.Homepage == "" {
+		return fmt.Errorf("scripts.homepage is required when homepage.generator is '%s'", homepageScript)
+	}
+	if cfg.Homepage.PageSize < 0 {
+		return fmt.Errorf("homepage.page-size can't be negative, got %d", cfg.Homepage.PageSize)
+	}
+	if cfg.Drive.WatchMode != watchModeFiles && cfg.Drive.WatchMode != watchModeChanges {
+		return fmt.Errorf("drive.watch-mode must be '%s' or '%s', got '%s'", watchModeFiles, watchModeChanges, cfg.Drive.WatchMode)
+	}
+	if cfg.Drive.RescanInterval < 0 {
+		return fmt.Errorf("drive.rescan-interval can't be negative, got %s", cfg.Drive.RescanInterval)
+	}
+	if cfg.Drive.PageSize < 1 || cfg.Drive.PageSize > 1000 {
+		return fmt.Errorf("drive.page-size must be between 1 and 1000, got %d", cfg.Drive.PageSize)
+	}
+	if cfg.Drive.ChannelTTL <= 0 || cfg.Drive.ChannelTTL > maxChannelTTL {
+		return fmt.Errorf("drive.channel-ttl must be between 0 and %s, got %s", maxChannelTTL, cfg.Drive.ChannelTTL)
+	}
+	if cfg.Drive.ChannelRenewBefore <= 0 || cfg.Drive.ChannelRenewBefore >= cfg.Drive.ChannelTTL {
+		return fmt.Errorf("drive.channel-renew-before must be positive and less than drive.channel-ttl, got %s", cfg.Drive.ChannelRenewBefore)
+	}
+	if cfg.Admin.ListenAddress != "" && cfg.Admin.Socket != "" {
+		return fmt.Errorf("admin.listen-address and admin.socket can't both be set")
+	}
+	if cfg.Admin.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.Admin.ListenAddress); err != nil {
+			return fmt.Errorf("admin.listen-address must be of the form host:port: %s", err.Error())
+		}
+	}
+	names := make(map[string]bool)
+	for _, client := range cfg.adminClients() {
+		if client.Name == "" || names[client.Name] {
+			return fmt.Errorf("admin.clients need unique names, got '%s'", client.Name)
+		}
+		if client.Token == "" && client.HMACSecret == "" {
+			return fmt.Errorf("admin client '%s' needs a token or an hmac_secret", client.Name)
+		}
+		names[client.Name] = true
+	}
+	if len(names) == 0 && cfg.Admin.Socket == "" {
+		return fmt.Errorf("admin.token, admin.hmac-secret or admin.clients is required unless the admin API is only served on admin.socket")
+	}
+	if cfg.Build.Workers < 1 {
+		return fmt.Errorf("build.workers must be at least 1, got %d", cfg.Build.Workers)
+	}
+	if cfg.Shutdown.Timeout <= 0 {
+		return fmt.Errorf("shutdown.timeout must be positive, got %s", cfg.Shutdown.Timeout)
+	}
+	if cfg.Debounce.QuietPeriod <= 0 {
+		return fmt.Errorf("debounce.quiet-period must be positive, got %s", cfg.Debounce.QuietPeriod)
+	}
+	if cfg.Debounce.MaxWait < cfg.Debounce.QuietPeriod {
+		return fmt.Errorf("debounce.max-wait can't be less than debounce.quiet-period, got %s", cfg.Debounce.MaxWait)
+	}
+	switch cfg.Deploy.Method {
+	case deployLocal:
+		if cfg.Deploy.Target == "" {
+			return fmt.Errorf("deploy.target is required when deploy.method is '%s'", deployLocal)
+		}
+	case deployRsync:
+		if cfg.Deploy.Target == "" || cfg.Deploy.Rsync == "" {
+			return fmt.Errorf("deploy.target and deploy.rsync are required when deploy.method is '%s'", deployRsync)
+		}
+	case deployS3:
+		if cfg.Deploy.S3.Endpoint == "" || cfg.Deploy.S3.Bucket == "" {
+			return fmt.Errorf("deploy.s3.endpoint and deploy.s3.bucket are required when deploy.method is '%s'", deployS3)
+		}
+	default:
+		return fmt.Errorf("deploy.method must be '%s', '%s' or '%s', got '%s'", deployLocal, deployRsync, deployS3, cfg.Deploy.Method)
+	}
+
+	return nil
+}
+
+// adminClients returns the configured admin clients, including the one set with admin.token and admin.hmac-secret
+func (cfg *Config) adminClients() []adminClient {
+	clients := append([]adminClient(nil), cfg.Admin.Clients...)
+	if cfg.Admin.Token != "" || cfg.Admin.HMACSecret != "" {
+		clients = append(clients, adminClient{Name: "admin", Token: cfg.Admin.Token, HMACSecret: cfg.Admin.HMACSecret})
+	}
+	return clients
+}
+
+// postDownloadDir is the local directory a post's files are downloaded into
+func (cfg *Config) postDownloadDir(post *Post) string {
+	return fmt.Sprintf("%s/%s/%s", cfg.Drive.DownloadDir, post.Author, post.Date)
+}
+
+// postHTMLDir is the directory a post's html is generated into
+func (cfg *Config) postHTMLDir(post *Post) string {
+	return fmt.Sprintf("%s/%s/%s/%s", cfg.HTML.OutputDir, cfg.HTML.PostsDir, post.Author, post.Date)
+}
+
+/*****************************
+* flag.Value implementations *
+*****************************/
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v.p = i
+	return nil
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v.p = b
+	return nil
+}
+
+// IsBoolFlag lets boolean options be given as a bare -flag
+func (v boolValue) IsBoolFlag() bool { return true }
+
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return v.p.String()
+}
+
+func (v durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v.p = d
+	return nil
+}
+
+func stringField(field func(c *Config) *string) func(c *Config) flag.Value {
+	return func(c *Config) flag.Value { return stringValue{field(c)} }
+}
+
+func intField(field func(c *Config) *int) func(c *Config) flag.Value {
+	return func(c *Config) flag.Value { return intValue{field(c)} }
+}
+
+func boolField(field func(c *Config) *bool) func(c *Config) flag.Value {
+	return func(c *Config) flag.Value { return boolValue{field(c)} }
+}
+
+func durationField(field func(c *Config) *time.Duration) func(c *Config) flag.Value {
+	return func(c *Config) flag.Value { return durationValue{field(c)} }
+}
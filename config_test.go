@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfigFile is a complete config for a local source, to which tests add their own lines
+const testConfigFile = `
+source: local
+local:
+  root_dir: /srv/posts
+drive:
+  download_dir: /var/lib/attic/downloads
+html:
+  output_dir: /var/lib/attic/html
+admin:
+  token: secret
+deploy:
+  method: local
+  target: /srv/www
+`
+
+// writeTestConfig writes testConfigFile followed by extra and returns its path
+func writeTestConfig(t *testing.T, extra string) string {
+	t.Helper()
+
+	dir := tempDir(t)
+	writeTree(t, dir, map[string]string{"config.yaml": testConfigFile + extra})
+	return filepath.Join(dir, "config.yaml")
+}
+
+// setTestEnv sets an environment variable until the test ends
+func setTestEnv(t *testing.T, name string, value string) {
+	t.Helper()
+
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     string
+		flag    string
+		workers int
+	}{
+		{"default", "", "", "", 2},
+		{"file over default", "build:\n  workers: 3\n", "", "", 3},
+		{"env over default", "", "4", "", 4},
+		{"env over file", "build:\n  workers: 3\n", "4", "", 4},
+		{"flag over file", "build:\n  workers: 3\n", "", "5", 5},
+		{"flag over env", "build:\n  workers: 3\n", "4", "5", 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := []string{"-config", writeTestConfig(t, test.file)}
+			if test.env != "" {
+				setTestEnv(t, configEnvPrefix+"BUILD_WORKERS", test.env)
+			}
+			if test.flag != "" {
+				args = append(args, "-build.workers", test.flag)
+			}
+
+			cfg, err := loadConfig(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Build.Workers != test.workers {
+				t.Errorf("build.workers is %d, want %d", cfg.Build.Workers, test.workers)
+			}
+			if cfg.Local.RootDir != "/srv/posts" || cfg.Deploy.Target != "/srv/www" {
+				t.Errorf("config file values weren't loaded: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestConfigFileFromEnv(t *testing.T) {
+	setTestEnv(t, configEnvPrefix+"CONFIG", writeTestConfig(t, "build:\n  workers: 3\n"))
+
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Build.Workers != 3 {
+		t.Errorf("build.workers is %d, want the config file's 3", cfg.Build.Workers)
+	}
+}
+
+func TestConfigFileRejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		key   string
+	}{
+		{"top level", "listen_adress: :9001\n", "listen_adress"},
+		{"nested", "thumbnail:\n  qualty: 90\n", "qualty"},
+		{"nested in the last section", "  s3:\n    buckets: www\n", "buckets"}, // below deploy
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig([]string{"-config", writeTestConfig(t, test.extra)})
+		if err == nil || !strings.Contains(err.Error(), test.key) {
+			t.Errorf("%s: error is %v, want one naming %s", test.name, err, test.key)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		err    string // part of the expected error, or empty if the config is valid
+	}{
+		{"valid", func(cfg *Config) {}, ""},
+		{"missing required value", func(cfg *Config) { cfg.HTML.OutputDir = "" }, "html.output-dir"},
+		{"unknown source", func(cfg *Config) { cfg.Source = "dropbox" }, "source must be"},
+		{"local source without root", func(cfg *Config) { cfg.Local.RootDir = "" }, "local.root-dir"},
+		{"drive source without webhook", func(cfg *Config) { cfg.Source = sourceDrive }, "webhook-address"},
+		{"drive source with http webhook", func(cfg *Config) {
+			cfg.Source = sourceDrive
+			cfg.WebhookAddress = "http://example.com/api"
+		}, "https"},
+		{"invalid listen address", func(cfg *Config) { cfg.ListenAddress = "9000" }, "listen-address"},
+		{"missing admin credential", func(cfg *Config) { cfg.Admin.Token = "" }, "admin.token"},
+		{"admin API only on a socket", func(cfg *Config) {
+			cfg.Admin.Token = ""
+			cfg.Admin.Socket = "/run/attic/admin.sock"
+		}, ""},
+		{"admin client without credential", func(cfg *Config) {
+			cfg.Admin.Clients = []adminClient{{Name: "ci"}}
+		}, "needs a token"},
+		{"duplicate admin client", func(cfg *Config) {
+			cfg.Admin.Clients = []adminClient{{Name: "admin", Token: "other"}}
+		}, "unique names"},
+		{"unknown deploy method", func(cfg *Config) { cfg.Deploy.Method = "ftp" }, "deploy.method"},
+		{"local deploy without target", func(cfg *Config) { cfg.Deploy.Target = "" }, "deploy.target"},
+		{"s3 deploy without bucket", func(cfg *Config) {
+			cfg.Deploy.Method = deployS3
+			cfg.Deploy.S3.Endpoint = "s3.example.com"
+		}, "deploy.s3.bucket"},
+		{"unknown watch mode", func(cfg *Config) { cfg.Drive.WatchMode = "poll" }, "drive.watch-mode"},
+		{"channel renewed after it expires", func(cfg *Config) {
+			cfg.Drive.ChannelRenewBefore = cfg.Drive.ChannelTTL
+		}, "drive.channel-renew-before"},
+		{"script converter without script", func(cfg *Config) { cfg.Convert.Converter = converterScript }, "scripts.convert"},
+		{"max wait shorter than quiet period", func(cfg *Config) {
+			cfg.Debounce.MaxWait = cfg.Debounce.QuietPeriod / 2
+		}, "debounce.max-wait"},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.Source = sourceLocal
+		cfg.Local.RootDir = "/srv/posts"
+		cfg.Drive.DownloadDir = "/var/lib/attic/downloads"
+		cfg.HTML.OutputDir = "/var/lib/attic/html"
+		cfg.Admin.Token = "secret"
+		cfg.Deploy.Method = deployLocal
+		cfg.Deploy.Target = "/srv/www"
+		cfg.defaultGenerators()
+		test.change(cfg)
+
+		err := cfg.validate()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: error is %v, want one mentioning %s", test.name, err, test.err)
+		}
+	}
+}
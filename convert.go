@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"attic-update-posts/docx"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	converterNative = "native"
+	converterScript = "script"
+)
+
+// postImageDir is where images embedded in a post are written, relative to the post's html directory
+const postImageDir = "images"
+
+// postGalleryDir is where a post's gallery images are copied, relative to the post's html directory
+const postGalleryDir = "gallery"
+
+// galleryQuality is the jpeg quality gallery images are saved with when they have to be turned upright
+const galleryQuality = 90
+
+// defaultPostTemplate is used when no convert.template is configured
+const defaultPostTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<article>
+<header>
+<h1>{{with .DocumentTitle}}{{.}}{{else}}{{.Title}}{{end}}</h1>
+<p class="byline">{{.Author}}, {{.Date}}</p>
+</header>
+{{.Body}}
+{{with .Images}}<section class="gallery">
+{{range .}}<a href="{{.URL}}"><img src="{{.URL}}" alt="{{.Name}}"></a>
+{{end}}</section>
+{{end}}</article>
+</body>
+</html>
+`
+
+// postPage is the data the post template is executed with
+type postPage struct {
+	Title         string
+	DocumentTitle string // the document's own Title-styled paragraph, if it has one; it isn't repeated in Body
+	Author        string
+	Date          string
+	Body          template.HTML
+	Images        []galleryImage // the post's gallery
+}
+
+// galleryImage is one of a post's gallery images, as published in its html directory
+type galleryImage struct {
+	Name string // the image's name in the source
+	URL  string // relative to the post's page
+
+	path string // of the downloaded image
+}
+
+// postGallery lists the post's gallery images, by name. HEIC and HEIF images are published as the jpeg they're
+// converted to.
+func postGallery(cfg *Config, post Post) []galleryImage {
+	images := make([]galleryImage, 0, len(post.gallery))
+	for _, image := range post.gallery {
+		p := downloadedImagePath(cfg.postDownloadDir(&post), image)
+		images = append(images, galleryImage{
+			Name: image.Name,
+			URL:  postGalleryDir + "/" + url.PathEscape(filepath.Base(p)),
+			path: p,
+		})
+	}
+	return images
+}
+
+// copyGallery replaces the gallery in the post's html directory with the post's downloaded gallery images, before
+// the post is converted, so both converters can link to them
+func copyGallery(cfg *Config, post Post, htmlDirectory string, log *logrus.Entry) error {
+	galleryDirectory := filepath.Join(htmlDirectory, postGalleryDir)
+	if err := os.RemoveAll(galleryDirectory); err != nil {
+		return fmt.Errorf("Error removing old gallery: %s", err.Error())
+	}
+
+	images := postGallery(cfg, post)
+	if len(images) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(galleryDirectory, os.ModePerm); err != nil {
+		return fmt.Errorf("Error creating gallery directory: %s", err.Error())
+	}
+	for _, image := range images {
+		b, err := ioutil.ReadFile(image.path)
+		if err != nil {
+			return fmt.Errorf("Error reading gallery image '%s': %s", image.Name, err.Error())
+		}
+		if b, err = uprightJPEG(b); err != nil {
+			return fmt.Errorf("Error turning gallery image '%s' upright: %s", image.Name, err.Error())
+		}
+		if err := ioutil.WriteFile(filepath.Join(galleryDirectory, filepath.Base(image.path)), b, 0664); err != nil {
+			return fmt.Errorf("Error saving gallery image '%s': %s", image.Name, err.Error())
+		}
+	}
+
+	log.WithField("images", len(images)).Debug("Copied gallery images")
+	return nil
+}
+
+// uprightJPEG turns a jpeg upright as its EXIF orientation says, like loadCover does for covers, so the gallery
+// doesn't rely on browsers following EXIF. The jpeg is encoded again without EXIF, so nothing turns it a second time.
+// Upright jpegs and other images are returned as they are.
+func uprightJPEG(b []byte) ([]byte, error) {
+	orientation := exifOrientation(b)
+	if orientation == 1 {
+		return b, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: galleryQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// postTitle is a post's title, taken from its file name
+func postTitle(post Post) string {
+	return strings.TrimSuffix(post.FileName, filepath.Ext(post.FileName))
+}
+
+// convertPost turns the downloaded post file into html in htmlDirectory. The native converter falls back to the
+// convert script, if one is configured, when it fails.
+func convertPost(cfg *Config, post Post, htmlDirectory string, steps *buildSteps, log *logrus.Entry) error {
+	defer observeStage(stageConvert, time.Now())
+
+	if cfg.Convert.Converter == converterNative {
+		started := time.Now()
+		err := convertPostNative(cfg, post, htmlDirectory, log)
+		steps.step(stageConvert, started, err)
+		if err == nil || cfg.Scripts.Convert == "" {
+			return err
+		}
+		log.WithError(err).Warn("Native docx conversion failed, falling back to convert script")
+	}
+
+	return convertPostScript(cfg, post, htmlDirectory, steps, log)
+}
+
+func convertPostNative(cfg *Config, post Post, htmlDirectory string, log *logrus.Entry) error {
+	log.WithField("postPath", post.postPath).Info("Converting post html from docx")
+
+	doc, err := docx.ConvertFile(post.postPath, docx.Options{ImagePrefix: postImageDir + "/"})
+	if err != nil {
+		log.WithError(err).Error("Failed to convert post docx")
+		return err
+	}
+
+	/***********************
+	* save embedded images *
+	***********************/
+
+	if len(doc.Images) > 0 {
+		imageDirectory := filepath.Join(htmlDirectory, postImageDir)
+		if err := os.MkdirAll(imageDirectory, os.ModePerm); err != nil {
+			log.WithError(err).Error("Error creating post image directory")
+			return err
+		}
+		for _, image := range doc.Images {
+			if err := ioutil.WriteFile(filepath.Join(imageDirectory, image.Name), image.Data, 0664); err != nil {
+				log.WithError(err).WithField("image", image.Name).Error("Error saving embedded image")
+				return err
+			}
+		}
+	}
+
+	/**********************
+	* render the template *
+	**********************/
+
+	tmpl, err := loadPostTemplate(cfg)
+	if err != nil {
+		log.WithError(err).Error("Error loading post template")
+		return err
+	}
+
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, postPage{
+		Title:         postTitle(post),
+		DocumentTitle: doc.Title,
+		Author:        post.Author,
+		Date:          post.Date,
+		Body:          template.HTML(doc.Body),
+		Images:        postGallery(cfg, post),
+	}); err != nil {
+		log.WithError(err).Error("Error rendering post template")
+		return err
+	}
+
+	outputPath := filepath.Join(htmlDirectory, cfg.Convert.OutputFile)
+	if err := ioutil.WriteFile(outputPath, page.Bytes(), 0664); err != nil {
+		log.WithError(err).Error("Error saving post html")
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"outputPath": outputPath,
+		"images":     len(doc.Images),
+	}).Info("Successfully converted post html from docx")
+	return nil
+}
+
+// loadPostTemplate parses the configured post template, read fresh each time so it can be edited without a restart
+func loadPostTemplate(cfg *Config) (*template.Template, error) {
+	if cfg.Convert.Template == "" {
+		return template.New("post").Parse(defaultPostTemplate)
+	}
+
+	b, err := ioutil.ReadFile(cfg.Convert.Template)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading post template: %s", err.Error())
+	}
+	return template.New(filepath.Base(cfg.Convert.Template)).Parse(string(b))
+}
+
+func convertPostScript(cfg *Config, post Post, htmlDirectory string, steps *buildSteps, log *logrus.Entry) error {
+	var args []string
+	args = append(args, cfg.Scripts.Convert, "post")
+	args = append(args, post.postPath, htmlDirectory)
+
+	log.WithField("cmd", strings.Join(args, " ")).Info("Running script to update post html from docx")
+
+	stdout, stderr, err := steps.command("convert script", exec.Command(args[0], args[1:]...))
+	if err != nil {
+		log.WithError(err).WithField("stderr", stderr).Error("Failed to run script to update post html from docx")
+		return err
+	}
+
+	log.WithField("stdout", stdout).Info("Successfully ran script to update post html from docx")
+	return nil
+}
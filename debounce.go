@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// updateScheduler debounces post builds. Every change to a post restarts its quiet period, and the post is built
+// once the quiet period passes without another change, so a build always includes an author's final edits. A post
+// that keeps changing is still built once it has waited max-wait since its first unbuilt change.
+type updateScheduler struct {
+	cfg   *Config
+	build func(post *Post) // hands the post to the build queue
+
+	lock    sync.Mutex
+	pending map[*Post]*pendingUpdate
+	stopped bool
+}
+
+type pendingUpdate struct {
+	first   time.Time // first change since the post was last built
+	last    time.Time // latest change
+	changes int
+	buildAt time.Time
+	timer   *time.Timer
+}
+
+func newUpdateScheduler(cfg *Config, build func(post *Post)) *updateScheduler {
+	return &updateScheduler{
+		cfg:     cfg,
+		build:   build,
+		pending: make(map[*Post]*pendingUpdate),
+	}
+}
+
+// schedule records a change to the post, (re)starting its quiet period. Changes are ignored once the scheduler is
+// stopped.
+func (s *updateScheduler) schedule(post *Post) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return
+	}
+
+	now := time.Now()
+	update, ok := s.pending[post]
+	if !ok {
+		update = &pendingUpdate{first: now}
+		s.pending[post] = update
+	} else {
+		skipNotification(skipDebounce)
+	}
+	update.last = now
+	update.changes++
+
+	update.buildAt = now.Add(s.cfg.Debounce.QuietPeriod)
+	if maxBuildAt := update.first.Add(s.cfg.Debounce.MaxWait); maxBuildAt.Before(update.buildAt) {
+		update.buildAt = maxBuildAt
+	}
+
+	if update.timer == nil {
+		update.timer = time.AfterFunc(update.buildAt.Sub(now), func() { s.fire(post) })
+	} else {
+		update.timer.Reset(update.buildAt.Sub(now))
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"post":    post,
+		"changes": update.changes,
+		"buildAt": update.buildAt,
+	}).Debug("Scheduled post update")
+}
+
+// fire queues the build of a post whose quiet period has passed. Changes arriving after this schedule another build.
+func (s *updateScheduler) fire(post *Post) {
+	s.lock.Lock()
+	update, ok := s.pending[post]
+	if !ok || time.Now().Before(update.buildAt) { // rescheduled just as the timer fired
+		s.lock.Unlock()
+		return
+	}
+	delete(s.pending, post)
+	s.lock.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"post":    post,
+		"changes": update.changes,
+		"waited":  time.Since(update.first).String(),
+	}).Info("Building post after changes settled")
+	s.build(post)
+}
+
+// stop cancels every pending build and ignores changes from then on, returning how many posts were pending. Their
+// saved build results no longer match the source, so they're rebuilt on the next start.
+func (s *updateScheduler) stop() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+	dropped := len(s.pending)
+	for post, update := range s.pending {
+		update.timer.Stop()
+		delete(s.pending, post)
+	}
+	return dropped
+}
+
+/**************
+* queue state *
+**************/
+
+// queueState is every post waiting to be built: those whose changes are still settling, then the build queue, and
+// whether the site is waiting to be published
+type queueState struct {
+	Pending []pendingPost `json:"pending"`
+	Queued  []buildJob    `json:"queued"`
+	Running []buildJob    `json:"running"`
+	Site    siteState     `json:"site"`
+}
+
+type pendingPost struct {
+	Author      string    `json:"author"`
+	Date        string    `json:"date"`
+	Changes     int       `json:"changes"`
+	FirstChange time.Time `json:"firstChange"`
+	LastChange  time.Time `json:"lastChange"`
+	BuildAt     time.Time `json:"buildAt"`
+}
+
+// pendingPosts returns the posts whose changes are settling, soonest build first
+func (s *updateScheduler) pendingPosts() []pendingPost {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pending := make([]pendingPost, 0, len(s.pending))
+	for post, update := range s.pending {
+		pending = append(pending, pendingPost{
+			Author:      post.Author,
+			Date:        post.Date,
+			Changes:     update.changes,
+			FirstChange: update.first,
+			LastChange:  update.last,
+			BuildAt:     update.buildAt,
+		})
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].BuildAt.Before(pending[j].BuildAt) })
+	return pending
+}
+
+func HandleQueue(updates *updateScheduler, queue *buildQueue, site *sitePublisher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := queueState{Pending: updates.pendingPosts()}
+		state.Queued, state.Running = queue.snapshot()
+		state.Site = site.state()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			logrus.WithError(err).Error("Error writing queue state")
+		}
+	}
+}
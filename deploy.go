@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	deployLocal = "local"
+	deployRsync = "rsync"
+	deployS3    = "s3"
+)
+
+// Deployer publishes the generated website. Deploy mirrors sourceDir to the deployer's target, removing anything
+// there that's no longer in sourceDir. Deployers that run commands record them in steps.
+type Deployer interface {
+	Deploy(sourceDir string, steps *buildSteps, log *logrus.Entry) error
+}
+
+// newDeployer returns the Deployer selected by deploy.method
+func newDeployer(cfg *Config) (Deployer, error) {
+	switch cfg.Deploy.Method {
+	case deployLocal:
+		return &localDeployer{target: cfg.Deploy.Target, contents: cfg.Deploy.Contents}, nil
+	case deployRsync:
+		return &rsyncDeployer{sudo: cfg.Deploy.Sudo, rsync: cfg.Deploy.Rsync, target: cfg.Deploy.Target, contents: cfg.Deploy.Contents}, nil
+	case deployS3:
+		client, err := minio.New(cfg.Deploy.S3.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(cfg.Deploy.S3.AccessKey, cfg.Deploy.S3.SecretKey, ""),
+			Secure: !cfg.Deploy.S3.Insecure,
+			Region: cfg.Deploy.S3.Region,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error creating S3 client: %s", err.Error())
+		}
+		return &s3Deployer{client: client, bucket: cfg.Deploy.S3.Bucket, prefix: cfg.Deploy.S3.Prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown deploy method '%s'", cfg.Deploy.Method)
+	}
+}
+
+// deploySite publishes the html output directory with the configured deployer
+func deploySite(cfg *Config, steps *buildSteps, log *logrus.Entry) error {
+	defer observeStage(stageDeploy, time.Now())
+
+	deployer, err := newDeployer(cfg)
+	if err != nil {
+		log.WithError(err).Error("Error setting up deployer")
+		return err
+	}
+
+	log = log.WithField("method", cfg.Deploy.Method)
+	log.Debug("Deploying html to website root")
+	started := time.Now()
+	err = deployer.Deploy(cfg.HTML.OutputDir, steps, log)
+	steps.step(stageDeploy, started, err)
+	if err != nil {
+		log.WithError(err).Error("Failed to deploy html to website root")
+		return err
+	}
+
+	log.Debug("Successfully deployed html to website root")
+	return nil
+}
+
+/*****************************
+* local directory deployment *
+*****************************/
+
+// localDeployer copies the site into a directory on this machine, without needing sudo or rsync. Like rsync, it
+// copies the source directory itself into target unless contents is set.
+type localDeployer struct {
+	target   string
+	contents bool
+}
+
+func (d *localDeployer) Deploy(sourceDir string, steps *buildSteps, log *logrus.Entry) error {
+	target := d.target
+	if !d.contents {
+		target = filepath.Join(target, filepath.Base(filepath.Clean(sourceDir)))
+	}
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return fmt.Errorf("Error creating deploy target: %s", err.Error())
+	}
+
+	copied := 0
+	keep := make(map[string]bool)
+	err := filepath.Walk(sourceDir, func(src string, info os.FileInfo, err error) error {
+		if vanished(sourceDir, src, err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, src)
+		if err != nil {
+			return err
+		}
+		keep[rel] = true
+		dst := filepath.Join(target, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dst, os.ModePerm)
+		case info.Mode()&os.ModeSymlink != 0:
+			return copySymlink(src, dst)
+		case info.Mode().IsRegular():
+			changed, err := copyIfChanged(src, dst, info)
+			if changed {
+				copied++
+			}
+			if vanished(sourceDir, src, err) {
+				delete(keep, rel)
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error copying site: %s", err.Error())
+	}
+
+	/***********************************
+	* delete files removed from source *
+	***********************************/
+
+	var stale []string
+	err = filepath.Walk(target, func(dst string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(target, dst)
+		if err != nil {
+			return err
+		}
+		if !keep[rel] {
+			stale = append(stale, dst)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error listing deploy target: %s", err.Error())
+	}
+	for _, dst := range stale {
+		if err := os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("Error deleting '%s' from deploy target: %s", dst, err.Error())
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"copied":  copied,
+		"deleted": len(stale),
+	}).Debug("Synced site to local directory")
+	return nil
+}
+
+// copyIfChanged copies a regular file unless dst already has the same size and modification time. The copy is
+// written next to dst and renamed into place, so readers never see a partial file.
+func copyIfChanged(src string, dst string, info os.FileInfo) (bool, error) {
+	if existing, err := os.Lstat(dst); err == nil && existing.Mode().IsRegular() &&
+		existing.Size() == info.Size() && existing.ModTime().Equal(info.ModTime()) {
+		return false, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return false, err
+	}
+	if err := os.RemoveAll(dst); err != nil { // dst may be a directory or symlink in the way
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), dst)
+}
+
+// copySymlink recreates a symlink, like rsync -l
+func copySymlink(src string, dst string) error {
+	link, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Readlink(dst); err == nil && existing == link {
+		return nil
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	return os.Symlink(link, dst)
+}
+
+/*******************
+* rsync deployment *
+*******************/
+
+// rsyncDeployer runs rsync, optionally through sudo, to publish the site. Without contents, the source directory
+// itself is synced into target, so html.output_dir /home/grish/html/html and target /usr/local/www deploy to
+// /usr/local/www/html.
+type rsyncDeployer struct {
+	sudo     string
+	rsync    string
+	target   string
+	contents bool
+}
+
+func (d *rsyncDeployer) Deploy(sourceDir string, steps *buildSteps, log *logrus.Entry) error {
+	var args []string
+	if d.sudo != "" {
+		args = append(args, d.sudo)
+	}
+	source := strings.TrimSuffix(sourceDir, "/")
+	if d.contents {
+		// the trailing slash syncs the directory's contents rather than the directory itself
+		source += "/"
+	}
+	args = append(args, d.rsync, "-rl", "--delete", source, d.target)
+
+	log.WithField("cmd", strings.Join(args, " ")).Debug("Running command to sync html posts to attic root")
+
+	stdout, stderr, err := steps.command("rsync", exec.Command(args[0], args[1:]...))
+	if err != nil {
+		log.WithError(err).WithField("stderr", stderr).Error("Failed to run command to sync html posts to attic root")
+		return err
+	}
+
+	log.WithField("stdout", stdout).Debug("Successfully ran command to sync html posts to attic root")
+	return nil
+}
+
+/***************************
+* S3-compatible deployment *
+***************************/
+
+// s3Deployer uploads the site to a bucket on any S3-compatible object store (AWS, MinIO, ...)
+type s3Deployer struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (d *s3Deployer) Deploy(sourceDir string, steps *buildSteps, log *logrus.Entry) error {
+	ctx := context.Background()
+	prefix := strings.Trim(d.prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	// objects already in the bucket, by key, with their etag
+	existing := make(map[string]string)
+	for object := range d.client.ListObjects(ctx, d.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("Error listing bucket '%s': %s", d.bucket, object.Err.Error())
+		}
+		existing[object.Key] = strings.Trim(object.ETag, `"`)
+	}
+
+	uploaded := 0
+	keep := make(map[string]bool)
+	err := filepath.Walk(sourceDir, func(src string, info os.FileInfo, err error) error {
+		if vanished(sourceDir, src, err) {
+			return nil
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, src)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+		keep[key] = true
+
+		// single-part uploads have the content's md5 as their etag
+		sum, err := fileMD5(src)
+		if vanished(sourceDir, src, err) {
+			delete(keep, key)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if existing[key] == sum {
+			return nil
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(key))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if _, err := d.client.FPutObject(ctx, d.bucket, key, src, minio.PutObjectOptions{ContentType: contentType}); err != nil {
+			return fmt.Errorf("Error uploading '%s': %s", key, err.Error())
+		}
+		uploaded++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for key := range existing {
+		if keep[key] {
+			continue
+		}
+		if err := d.client.RemoveObject(ctx, d.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("Error deleting '%s': %s", key, err.Error())
+		}
+		deleted++
+	}
+
+	log.WithFields(logrus.Fields{
+		"bucket":   d.bucket,
+		"uploaded": uploaded,
+		"deleted":  deleted,
+	}).Debug("Synced site to object store")
+	return nil
+}
+
+// vanished reports whether err came from a file below sourceDir that was removed while the site was being deployed.
+// A post build can rewrite its directory during a deploy, and requests another deploy once it's done, so the file is
+// skipped rather than failing this one.
+func vanished(sourceDir string, src string, err error) bool {
+	if err == nil || src == sourceDir {
+		return false
+	}
+	_, statErr := os.Lstat(src)
+	return os.IsNotExist(statErr)
+}
+
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
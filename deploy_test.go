@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/sirupsen/logrus"
+)
+
+func testLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logrus.NewEntry(logger)
+}
+
+// tempDir makes a directory removed when the test finishes
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "attic-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeTree writes files, keyed by slash-separated path relative to dir
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree reads every regular file under dir, keyed by slash-separated path relative to dir
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func equalFiles(t *testing.T, got map[string]string, want map[string]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("got files %v, want %v", got, want)
+		return
+	}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s = %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+/************
+* deployers *
+************/
+
+func TestRsyncDeployerSource(t *testing.T) {
+	dir := tempDir(t)
+	argsFile := filepath.Join(dir, "args")
+	rsync := filepath.Join(dir, "rsync")
+	if err := ioutil.WriteFile(rsync, []byte("#!/bin/sh\necho \"$@\" > "+argsFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		contents bool
+		args     string
+	}{
+		{false, "-rl --delete /home/grish/html/html /usr/local/www"},
+		{true, "-rl --delete /home/grish/html/html/ /usr/local/www"},
+	}
+	for _, test := range tests {
+		d := &rsyncDeployer{rsync: rsync, target: "/usr/local/www", contents: test.contents}
+		if err := d.Deploy("/home/grish/html/html/", nil, testLog()); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args := strings.TrimSpace(string(b)); args != test.args {
+			t.Errorf("contents %v: rsync args %q, want %q", test.contents, args, test.args)
+		}
+	}
+}
+
+func TestLocalDeployer(t *testing.T) {
+	tests := []struct {
+		contents bool
+		dir      string
+	}{
+		{false, "html"},
+		{true, "."},
+	}
+	for _, test := range tests {
+		source := filepath.Join(tempDir(t), "html")
+		target := tempDir(t)
+		writeTree(t, target, map[string]string{"other/keep.txt": "not ours"})
+		writeTree(t, source, map[string]string{
+			"index.html":                  "home",
+			"posts/alice/a/index.html":    "a",
+			"posts/alice/b/index.html":    "b",
+			"posts/alice/b/cover.jpg":     "cover",
+			"posts/alice/b/gallery/1.jpg": "1",
+		})
+
+		d := &localDeployer{target: target, contents: test.contents}
+		if err := d.Deploy(source, nil, testLog()); err != nil {
+			t.Fatal(err)
+		}
+		deployed := filepath.Join(target, test.dir)
+		equalFiles(t, readTree(t, deployed), readTree(t, source))
+
+		// a removed post is deleted from the target
+		if err := os.RemoveAll(filepath.Join(source, "posts", "alice", "b")); err != nil {
+			t.Fatal(err)
+		}
+		writeTree(t, source, map[string]string{"index.html": "home, updated"})
+		if err := d.Deploy(source, nil, testLog()); err != nil {
+			t.Fatal(err)
+		}
+		equalFiles(t, readTree(t, deployed), readTree(t, source))
+		if !test.contents {
+			// the rest of the target is left alone
+			equalFiles(t, readTree(t, filepath.Join(target, "other")), map[string]string{"keep.txt": "not ours"})
+		}
+	}
+}
+
+/****************
+* s3 deployment *
+****************/
+
+// TestS3Deployer runs against a local MinIO when ATTIC_TEST_S3_ENDPOINT, ATTIC_TEST_S3_BUCKET,
+// ATTIC_TEST_S3_ACCESS_KEY and ATTIC_TEST_S3_SECRET_KEY are set (over plain http, the bucket must already exist),
+// and against an in-process fake of the few S3 calls the deployer makes otherwise.
+func TestS3Deployer(t *testing.T) {
+	var client *minio.Client
+	var err error
+	bucket := os.Getenv("ATTIC_TEST_S3_BUCKET")
+	var fake *fakeS3
+	if endpoint := os.Getenv("ATTIC_TEST_S3_ENDPOINT"); endpoint != "" {
+		client, err = minio.New(endpoint, &minio.Options{
+			Creds: credentials.NewStaticV4(os.Getenv("ATTIC_TEST_S3_ACCESS_KEY"), os.Getenv("ATTIC_TEST_S3_SECRET_KEY"), ""),
+		})
+	} else {
+		bucket = "attic"
+		fake = &fakeS3{bucket: bucket, objects: make(map[string]fakeObject)}
+		server := httptest.NewTLSServer(fake)
+		t.Cleanup(server.Close)
+		client, err = minio.New(strings.TrimPrefix(server.URL, "https://"), &minio.Options{
+			Creds:     credentials.NewStaticV4("access", "secret", ""),
+			Secure:    true,
+			Region:    "us-east-1",
+			Transport: server.Client().Transport,
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := fmt.Sprintf("attic-test-%d", time.Now().UnixNano())
+	d := &s3Deployer{client: client, bucket: bucket, prefix: "/" + prefix + "/"}
+	source, empty := tempDir(t), tempDir(t)
+	t.Cleanup(func() {
+		// deploying an empty site deletes everything the test uploaded
+		d.Deploy(empty, nil, testLog())
+	})
+
+	writeTree(t, source, map[string]string{
+		"index.html":               "home",
+		"posts/alice/a/index.html": "a",
+		"posts/alice/a/cover.jpg":  "cover",
+	})
+	if err := d.Deploy(source, nil, testLog()); err != nil {
+		t.Fatal(err)
+	}
+	equalFiles(t, listBucket(t, client, bucket, prefix), readTree(t, source))
+	if fake != nil {
+		if fake.puts != 3 {
+			t.Errorf("first deploy uploaded %d objects, want 3", fake.puts)
+		}
+		if contentType := fake.objects[prefix+"/index.html"].contentType; !strings.HasPrefix(contentType, "text/html") {
+			t.Errorf("index.html uploaded as %q", contentType)
+		}
+	}
+
+	// only changed files are uploaded, and removed ones deleted
+	writeTree(t, source, map[string]string{"index.html": "home, updated"})
+	if err := os.Remove(filepath.Join(source, "posts", "alice", "a", "cover.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deploy(source, nil, testLog()); err != nil {
+		t.Fatal(err)
+	}
+	equalFiles(t, listBucket(t, client, bucket, prefix), readTree(t, source))
+	if fake != nil && fake.puts != 4 {
+		t.Errorf("second deploy uploaded %d objects, want 1", fake.puts-3)
+	}
+}
+
+// listBucket reads every object under prefix, keyed relative to it
+func listBucket(t *testing.T, client *minio.Client, bucket string, prefix string) map[string]string {
+	t.Helper()
+
+	ctx := context.Background()
+	files := make(map[string]string)
+	for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix + "/", Recursive: true}) {
+		if object.Err != nil {
+			t.Fatal(object.Err)
+		}
+		o, err := client.GetObject(ctx, bucket, object.Key, minio.GetObjectOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(o)
+		o.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(object.Key, prefix+"/")] = string(b)
+	}
+	return files
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+// fakeS3 serves a single bucket with the listing, upload, download and delete calls the deployer makes, without
+// checking signatures
+type fakeS3 struct {
+	lock    sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+	puts    int
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path != s.bucket && !strings.HasPrefix(path, s.bucket+"/") {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, s.bucket), "/")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, r.URL.Query().Get("prefix"))
+	case key == "":
+		http.Error(w, "unsupported bucket request", http.StatusNotImplemented)
+	case r.Method == http.MethodPut:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = fakeObject{data: data, contentType: r.Header.Get("Content-Type")}
+		s.puts++
+		w.Header().Set("ETag", `"`+etag(data)+`"`)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>no such key</Message></Error>`)
+			return
+		}
+		w.Header().Set("ETag", `"`+etag(object.data)+`"`)
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	default:
+		http.Error(w, "unsupported object request", http.StatusNotImplemented)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type contents struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []contents
+	}{Name: s.bucket, Prefix: prefix, MaxKeys: 1000}
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, contents{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         `"` + etag(s.objects[key].data) + `"`,
+			Size:         len(s.objects[key].data),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
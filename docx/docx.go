@@ -0,0 +1,365 @@
+// Package docx converts WordprocessingML (.docx) documents to HTML. It understands the parts of the format posts
+// use: paragraphs, headings, bold/italic/underline/strikethrough, bulleted and numbered lists, links, tables and
+// embedded images.
+package docx
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Image is a picture embedded in a document
+type Image struct {
+	Name string // file name, unique within the document
+	Data []byte
+}
+
+// Document is the result of converting a .docx file
+type Document struct {
+	Title  string // text of the first paragraph styled as a title, if any, which is left out of Body
+	Body   string // the document body as HTML
+	Images []Image
+}
+
+// Options changes how a document is converted
+type Options struct {
+	// ImagePrefix is prepended to image file names in <img> src attributes
+	ImagePrefix string
+}
+
+// ConvertFile converts the .docx file at path
+func ConvertFile(path string, opts Options) (*Document, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening docx file: %s", err.Error())
+	}
+	defer r.Close()
+
+	return convert(&r.Reader, opts)
+}
+
+// Convert converts a .docx file read from r
+func Convert(r io.ReaderAt, size int64, opts Options) (*Document, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening docx file: %s", err.Error())
+	}
+
+	return convert(zr, opts)
+}
+
+func convert(zr *zip.Reader, opts Options) (*Document, error) {
+	c := &converter{
+		opts:       opts,
+		files:      make(map[string]*zip.File),
+		images:     make(map[string]string),
+		imageNames: make(map[string]bool),
+		doc:        new(Document),
+	}
+	for _, f := range zr.File {
+		c.files[f.Name] = f
+	}
+
+	var document node
+	if err := c.readXML("word/document.xml", &document); err != nil {
+		return nil, err
+	}
+	body := document.child("body")
+	if body == nil {
+		return nil, fmt.Errorf("docx document has no body")
+	}
+
+	var err error
+	if c.rels, err = c.readRelationships("word/_rels/document.xml.rels"); err != nil {
+		return nil, err
+	}
+	if c.styles, err = c.readStyles("word/styles.xml"); err != nil {
+		return nil, err
+	}
+	if c.numbering, err = c.readNumbering("word/numbering.xml"); err != nil {
+		return nil, err
+	}
+
+	c.doc.Body = c.blocks(body.Nodes)
+	return c.doc, nil
+}
+
+/***************************
+* WordprocessingML parsing *
+***************************/
+
+// node is a generic XML element, keeping its children in document order
+type node struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []node     `xml:",any"`
+}
+
+// attr returns the value of the attribute with the given local name. It is safe to call on a nil node.
+func (n *node) attr(local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// child returns the first child element with the given local name. It is safe to call on a nil node.
+func (n *node) child(local string) *node {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// find returns the first descendant element with the given local name
+func (n *node) find(local string) *node {
+	if n == nil {
+		return nil
+	}
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == local {
+			return &n.Nodes[i]
+		}
+		if found := n.Nodes[i].find(local); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nodesOrNil returns the node's children. It is safe to call on a nil node.
+func (n *node) nodesOrNil() []node {
+	if n == nil {
+		return nil
+	}
+	return n.Nodes
+}
+
+// text returns the concatenated text of every w:t element below the node
+func (n *node) text() string {
+	var b strings.Builder
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == "t" {
+			b.WriteString(n.Nodes[i].Content)
+		} else {
+			b.WriteString(n.Nodes[i].text())
+		}
+	}
+	return b.String()
+}
+
+// toggle reports whether an on/off property like w:b is switched on
+func toggle(n *node) bool {
+	if n == nil {
+		return false
+	}
+	switch n.attr("val") {
+	case "0", "false", "off", "none":
+		return false
+	}
+	return true
+}
+
+type relationship struct {
+	ID         string `xml:"Id,attr"`
+	Target     string `xml:"Target,attr"`
+	TargetMode string `xml:"TargetMode,attr"`
+}
+
+type style struct {
+	name         string
+	headingLevel int
+}
+
+type converter struct {
+	opts       Options
+	files      map[string]*zip.File
+	rels       map[string]relationship
+	styles     map[string]style
+	numbering  map[string]map[string]string // numId -> level -> number format
+	images     map[string]string            // zip path -> image name
+	imageNames map[string]bool              // names given to images so far
+	doc        *Document
+}
+
+func (c *converter) read(name string) ([]byte, error) {
+	f, ok := c.files[name]
+	if !ok {
+		return nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("Error opening '%s' in docx: %s", name, err.Error())
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading '%s' in docx: %s", name, err.Error())
+	}
+	return b, nil
+}
+
+// readXML unmarshals a part of the document. Missing parts leave v untouched.
+func (c *converter) readXML(name string, v interface{}) error {
+	b, err := c.read(name)
+	if err != nil || b == nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Error parsing '%s' in docx: %s", name, err.Error())
+	}
+	return nil
+}
+
+func (c *converter) readRelationships(name string) (map[string]relationship, error) {
+	var parsed struct {
+		Relationships []relationship `xml:"Relationship"`
+	}
+	if err := c.readXML(name, &parsed); err != nil {
+		return nil, err
+	}
+
+	rels := make(map[string]relationship)
+	for _, rel := range parsed.Relationships {
+		rels[rel.ID] = rel
+	}
+	return rels, nil
+}
+
+func (c *converter) readStyles(name string) (map[string]style, error) {
+	var parsed node
+	if err := c.readXML(name, &parsed); err != nil {
+		return nil, err
+	}
+
+	styles := make(map[string]style)
+	for i := range parsed.Nodes {
+		n := &parsed.Nodes[i]
+		if n.XMLName.Local != "style" {
+			continue
+		}
+		s := style{name: n.child("name").attr("val")}
+		s.headingLevel = headingLevel(s.name)
+		if s.headingLevel == 0 {
+			s.headingLevel = outlineLevel(n.child("pPr"))
+		}
+		styles[n.attr("styleId")] = s
+	}
+	return styles, nil
+}
+
+func (c *converter) readNumbering(name string) (map[string]map[string]string, error) {
+	var parsed node
+	if err := c.readXML(name, &parsed); err != nil {
+		return nil, err
+	}
+
+	abstract := make(map[string]map[string]string)
+	for i := range parsed.Nodes {
+		n := &parsed.Nodes[i]
+		if n.XMLName.Local != "abstractNum" {
+			continue
+		}
+		levels := make(map[string]string)
+		for j := range n.Nodes {
+			if lvl := &n.Nodes[j]; lvl.XMLName.Local == "lvl" {
+				levels[lvl.attr("ilvl")] = lvl.child("numFmt").attr("val")
+			}
+		}
+		abstract[n.attr("abstractNumId")] = levels
+	}
+
+	numbering := make(map[string]map[string]string)
+	for i := range parsed.Nodes {
+		n := &parsed.Nodes[i]
+		if n.XMLName.Local == "num" {
+			numbering[n.attr("numId")] = abstract[n.child("abstractNumId").attr("val")]
+		}
+	}
+	return numbering, nil
+}
+
+// headingLevel maps style names like "heading 2" or "Title" to a heading level, or 0 for other styles
+func headingLevel(name string) int {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "title" {
+		return 1
+	}
+	if !strings.HasPrefix(name, "heading") {
+		return 0
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(name, "heading")))
+	if err != nil || level < 1 {
+		return 0
+	}
+	if level > 6 {
+		level = 6
+	}
+	return level
+}
+
+// outlineLevel returns the heading level given by a w:outlineLvl paragraph property, or 0 if there is none
+func outlineLevel(pPr *node) int {
+	lvl := pPr.child("outlineLvl")
+	if lvl == nil {
+		return 0
+	}
+	level, err := strconv.Atoi(lvl.attr("val"))
+	if err != nil || level > 5 { // level 9 is body text
+		return 0
+	}
+	return level + 1
+}
+
+// image adds an embedded image to the document and returns its src, or an empty string if it can't be found
+func (c *converter) image(relID string) (string, error) {
+	rel, ok := c.rels[relID]
+	if !ok {
+		return "", nil
+	}
+	if rel.TargetMode == "External" {
+		return rel.Target, nil
+	}
+
+	target := strings.TrimPrefix(rel.Target, "/")
+	if !strings.HasPrefix(target, "word/") {
+		target = path.Join("word", target)
+	}
+	if name, ok := c.images[target]; ok {
+		return c.opts.ImagePrefix + name, nil
+	}
+
+	data, err := c.read(target)
+	if err != nil || data == nil {
+		return "", err
+	}
+
+	// images in different folders of the zip can share a base name, so later ones get a numbered suffix
+	name := path.Base(target)
+	ext := path.Ext(name)
+	for i := 2; c.imageNames[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path.Base(target), ext), i, ext)
+	}
+	c.images[target] = name
+	c.imageNames[name] = true
+	c.doc.Images = append(c.doc.Images, Image{Name: name, Data: data})
+	return c.opts.ImagePrefix + name, nil
+}
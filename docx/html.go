@@ -0,0 +1,396 @@
+package docx
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*****************
+* block elements *
+*****************/
+
+// blocks renders a sequence of paragraphs and tables, grouping list paragraphs into (nested) lists
+func (c *converter) blocks(nodes []node) string {
+	var out strings.Builder
+	var lists listStack
+
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.XMLName.Local {
+		case "p":
+			c.paragraph(n, &out, &lists)
+		case "tbl":
+			lists.closeAll(&out)
+			out.WriteString(c.table(n))
+		case "sdt": // content control wrapping block content
+			lists.closeAll(&out)
+			out.WriteString(c.blocks(n.child("sdtContent").nodesOrNil()))
+		}
+	}
+
+	lists.closeAll(&out)
+	return out.String()
+}
+
+func (c *converter) paragraph(n *node, out *strings.Builder, lists *listStack) {
+	pPr := n.child("pPr")
+	styleID := pPr.child("pStyle").attr("val")
+	s, ok := c.styles[styleID]
+	if !ok {
+		s = style{name: styleID, headingLevel: headingLevel(styleID)}
+	}
+	level := s.headingLevel
+	if l := outlineLevel(pPr); l > 0 {
+		level = l
+	}
+
+	// the title is left to the page template, which is given it separately
+	if c.doc.Title == "" && strings.EqualFold(s.name, "title") {
+		if c.doc.Title = strings.TrimSpace(n.text()); c.doc.Title != "" {
+			lists.closeAll(out)
+			return
+		}
+	}
+
+	content := c.inlines(n.Nodes)
+
+	/***********************
+	* list item paragraphs *
+	***********************/
+
+	numPr := pPr.child("numPr")
+	if numID := numPr.child("numId").attr("val"); numID != "" && numID != "0" && level == 0 {
+		ilvl := numPr.child("ilvl").attr("val")
+		depth, _ := strconv.Atoi(ilvl)
+		tag := "ul"
+		if format := c.numbering[numID][ilvl]; format != "" && format != "bullet" && format != "none" {
+			tag = "ol"
+		}
+		lists.item(out, tag, depth)
+		out.WriteString(content)
+		return
+	}
+
+	lists.closeAll(out)
+	if strings.TrimSpace(content) == "" { // documents use empty paragraphs for spacing
+		return
+	}
+
+	tag := "p"
+	if level > 0 {
+		tag = fmt.Sprintf("h%d", level)
+	}
+	fmt.Fprintf(out, "<%s>%s</%s>\n", tag, content, tag)
+}
+
+// listStack tracks the lists that are open while rendering consecutive list paragraphs. Every open list has an open
+// <li>, which nested lists are written into.
+type listStack []listLevel
+
+type listLevel struct {
+	tag   string
+	depth int
+}
+
+// item starts a list item at the given depth, opening and closing lists as needed
+func (s *listStack) item(out *strings.Builder, tag string, depth int) {
+	for len(*s) > 0 && s.top().depth > depth {
+		s.pop(out)
+	}
+	if len(*s) > 0 && s.top().depth == depth {
+		if s.top().tag == tag {
+			out.WriteString("</li>\n")
+			out.WriteString("<li>")
+			return
+		}
+		s.pop(out)
+	}
+
+	fmt.Fprintf(out, "<%s>\n<li>", tag)
+	*s = append(*s, listLevel{tag: tag, depth: depth})
+}
+
+func (s *listStack) top() listLevel {
+	return (*s)[len(*s)-1]
+}
+
+func (s *listStack) pop(out *strings.Builder) {
+	fmt.Fprintf(out, "</li>\n</%s>\n", s.top().tag)
+	*s = (*s)[:len(*s)-1]
+}
+
+func (s *listStack) closeAll(out *strings.Builder) {
+	for len(*s) > 0 {
+		s.pop(out)
+	}
+}
+
+/*********
+* tables *
+*********/
+
+type tableCell struct {
+	content string
+	col     int
+	span    int
+	rowspan int
+	merge   string // "restart" or "continue" for vertically merged cells
+	header  bool
+}
+
+func (c *converter) table(n *node) string {
+	var rows [][]*tableCell
+	for i := range n.Nodes {
+		tr := &n.Nodes[i]
+		if tr.XMLName.Local != "tr" {
+			continue
+		}
+		header := tr.child("trPr").child("tblHeader") != nil
+
+		var row []*tableCell
+		col := 0
+		for j := range tr.Nodes {
+			tc := &tr.Nodes[j]
+			if tc.XMLName.Local != "tc" {
+				continue
+			}
+			tcPr := tc.child("tcPr")
+			cell := &tableCell{col: col, span: 1, rowspan: 1, header: header}
+			if span, err := strconv.Atoi(tcPr.child("gridSpan").attr("val")); err == nil && span > 1 {
+				cell.span = span
+			}
+			if vMerge := tcPr.child("vMerge"); vMerge != nil {
+				cell.merge = "continue"
+				if vMerge.attr("val") == "restart" {
+					cell.merge = "restart"
+				}
+			}
+			if cell.merge != "continue" {
+				cell.content = c.blocks(tc.Nodes)
+			}
+			row = append(row, cell)
+			col += cell.span
+		}
+		rows = append(rows, row)
+	}
+
+	// a vertically merged cell spans every following row that continues it
+	for r, row := range rows {
+		for _, cell := range row {
+			if cell.merge != "restart" {
+				continue
+			}
+			for _, next := range rows[r+1:] {
+				cont := cellAt(next, cell.col)
+				if cont == nil || cont.merge != "continue" {
+					break
+				}
+				cell.rowspan++
+			}
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("<table>\n")
+	for _, row := range rows {
+		out.WriteString("<tr>")
+		for _, cell := range row {
+			if cell.merge == "continue" {
+				continue
+			}
+			tag := "td"
+			if cell.header {
+				tag = "th"
+			}
+			out.WriteString("<" + tag)
+			if cell.span > 1 {
+				fmt.Fprintf(&out, ` colspan="%d"`, cell.span)
+			}
+			if cell.rowspan > 1 {
+				fmt.Fprintf(&out, ` rowspan="%d"`, cell.rowspan)
+			}
+			fmt.Fprintf(&out, ">%s</%s>", cell.content, tag)
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("</table>\n")
+	return out.String()
+}
+
+func cellAt(row []*tableCell, col int) *tableCell {
+	for _, cell := range row {
+		if cell.col == col {
+			return cell
+		}
+	}
+	return nil
+}
+
+/******************
+* inline elements *
+******************/
+
+// inlineWriter writes runs of text, only closing and reopening formatting tags where the formatting changes. Tags
+// are always nested in the same order so adjacent runs share as many open tags as possible.
+type inlineWriter struct {
+	out  strings.Builder
+	open []string
+}
+
+func (w *inlineWriter) format(tags []string) {
+	common := 0
+	for common < len(w.open) && common < len(tags) && w.open[common] == tags[common] {
+		common++
+	}
+	for i := len(w.open) - 1; i >= common; i-- {
+		w.out.WriteString("</" + w.open[i] + ">")
+	}
+	for _, tag := range tags[common:] {
+		w.out.WriteString("<" + tag + ">")
+	}
+	w.open = append(w.open[:common], tags[common:]...)
+}
+
+func (w *inlineWriter) text(s string) {
+	w.out.WriteString(html.EscapeString(s))
+}
+
+// raw writes markup outside of any formatting
+func (w *inlineWriter) raw(s string) {
+	w.format(nil)
+	w.out.WriteString(s)
+}
+
+func (w *inlineWriter) String() string {
+	w.format(nil)
+	return w.out.String()
+}
+
+func (c *converter) inlines(nodes []node) string {
+	w := new(inlineWriter)
+	c.writeInlines(w, nodes)
+	return w.String()
+}
+
+func (c *converter) writeInlines(w *inlineWriter, nodes []node) {
+	for i := range nodes {
+		n := &nodes[i]
+		switch n.XMLName.Local {
+		case "r":
+			c.run(w, n)
+		case "hyperlink":
+			href := "#" + n.attr("anchor")
+			if rel, ok := c.rels[n.attr("id")]; ok {
+				href = rel.Target
+			}
+			if !safeURL(href) { // keep the text of links that could run script
+				c.writeInlines(w, n.Nodes)
+				break
+			}
+			w.raw(fmt.Sprintf(`<a href="%s">`, html.EscapeString(href)))
+			c.writeInlines(w, n.Nodes)
+			w.raw("</a>")
+		case "fldSimple":
+			if href := fieldHyperlink(n.attr("instr")); href != "" && safeURL(href) {
+				w.raw(fmt.Sprintf(`<a href="%s">`, html.EscapeString(href)))
+				c.writeInlines(w, n.Nodes)
+				w.raw("</a>")
+			} else {
+				c.writeInlines(w, n.Nodes)
+			}
+		case "bookmarkStart":
+			if name := n.attr("name"); name != "" && !strings.HasPrefix(name, "_") { // skip Word's hidden bookmarks
+				w.raw(fmt.Sprintf(`<a id="%s"></a>`, html.EscapeString(name)))
+			}
+		case "ins", "smartTag", "customXml":
+			c.writeInlines(w, n.Nodes)
+		case "sdt":
+			c.writeInlines(w, n.child("sdtContent").nodesOrNil())
+		}
+	}
+}
+
+// safeURL reports whether a link or image target can be written into the page: relative, or http, https or mailto.
+// The body is inserted into the page as is, so nothing else filters out javascript: and the like.
+func safeURL(target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// fieldHyperlink returns the target of a HYPERLINK field instruction, or an empty string for other fields
+func fieldHyperlink(instr string) string {
+	fields := strings.Fields(instr)
+	if len(fields) < 2 || fields[0] != "HYPERLINK" {
+		return ""
+	}
+	return strings.Trim(fields[len(fields)-1], `"`)
+}
+
+func (c *converter) run(w *inlineWriter, n *node) {
+	tags := formatTags(n.child("rPr"))
+
+	for i := range n.Nodes {
+		child := &n.Nodes[i]
+		switch child.XMLName.Local {
+		case "t":
+			w.format(tags)
+			w.text(child.Content)
+		case "tab", "ptab":
+			w.format(tags)
+			w.text(" ")
+		case "noBreakHyphen":
+			w.format(tags)
+			w.text("-")
+		case "br", "cr":
+			if child.attr("type") != "page" {
+				w.raw("<br>")
+			}
+		case "drawing":
+			c.writeImage(w, child.find("blip").attr("embed"), child.find("docPr").attr("descr"))
+		case "pict":
+			c.writeImage(w, child.find("imagedata").attr("id"), "")
+		}
+	}
+}
+
+func (c *converter) writeImage(w *inlineWriter, relID string, alt string) {
+	src, err := c.image(relID)
+	if err != nil || src == "" || !safeURL(src) { // a missing image shouldn't lose the rest of the post
+		return
+	}
+	w.raw(fmt.Sprintf(`<img src="%s" alt="%s">`, html.EscapeString(src), html.EscapeString(alt)))
+}
+
+// formatTags returns the html tags for a run's formatting, in a fixed nesting order
+func formatTags(rPr *node) []string {
+	var tags []string
+	if toggle(rPr.child("b")) {
+		tags = append(tags, "strong")
+	}
+	if toggle(rPr.child("i")) {
+		tags = append(tags, "em")
+	}
+	if toggle(rPr.child("u")) {
+		tags = append(tags, "u")
+	}
+	if toggle(rPr.child("strike")) || toggle(rPr.child("dstrike")) {
+		tags = append(tags, "s")
+	}
+	switch rPr.child("vertAlign").attr("val") {
+	case "superscript":
+		tags = append(tags, "sup")
+	case "subscript":
+		tags = append(tags, "sub")
+	}
+	return tags
+}
@@ -0,0 +1,268 @@
+package docx
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testNamespaces = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+	`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"`
+
+// convertTestDocument converts a document with the given body xml and document relationships
+func convertTestDocument(t *testing.T, body string, rels string) *Document {
+	t.Helper()
+
+	return convertTestParts(t, body, rels, nil)
+}
+
+// convertTestParts converts a document with the given body xml, document relationships and other parts of the zip,
+// like word/styles.xml, by path
+func convertTestParts(t *testing.T, body string, rels string, parts map[string]string) *Document {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{
+		"word/document.xml": `<w:document ` + testNamespaces + `><w:body>` + body + `</w:body></w:document>`,
+		"word/_rels/document.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels + `</Relationships>`,
+	}
+	for name, content := range parts {
+		files[name] = content
+	}
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Convert(bytes.NewReader(buf.Bytes()), int64(buf.Len()), Options{ImagePrefix: "images/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestLinkSchemes(t *testing.T) {
+	tests := []struct {
+		target string
+		linked bool
+	}{
+		{"https://theattic.us/", true},
+		{"http://example.com/a?b=c", true},
+		{"mailto:grish@example.com", true},
+		{"gallery/photo.jpg", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"data:text/html;base64,PHNjcmlwdD4=", false},
+		{"vbscript:msgbox(1)", false},
+	}
+
+	for _, test := range tests {
+		rels := `<Relationship Id="rId1" Type="hyperlink" Target="` + test.target + `" TargetMode="External"/>`
+		doc := convertTestDocument(t, `<w:p><w:hyperlink r:id="rId1"><w:r><w:t>link</w:t></w:r></w:hyperlink></w:p>`, rels)
+
+		if linked := strings.Contains(doc.Body, "<a href="); linked != test.linked {
+			t.Errorf("%q: linked = %v, want %v; body %q", test.target, linked, test.linked, doc.Body)
+		}
+		if !strings.Contains(doc.Body, "link") {
+			t.Errorf("%q: link text dropped from body %q", test.target, doc.Body)
+		}
+	}
+}
+
+func TestFieldLinkAndExternalImageSchemes(t *testing.T) {
+	body := `<w:p><w:fldSimple w:instr=" HYPERLINK &quot;javascript:alert(1)&quot; "><w:r><w:t>field</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:pict><v:imagedata xmlns:v="urn:schemas-microsoft-com:vml" r:id="rId1"/></w:pict></w:r></w:p>` +
+		`<w:p><w:r><w:pict><v:imagedata xmlns:v="urn:schemas-microsoft-com:vml" r:id="rId2"/></w:pict></w:r></w:p>`
+	rels := `<Relationship Id="rId1" Type="image" Target="javascript:alert(1)" TargetMode="External"/>` +
+		`<Relationship Id="rId2" Type="image" Target="https://theattic.us/cover.jpg" TargetMode="External"/>`
+	doc := convertTestDocument(t, body, rels)
+
+	if strings.Contains(doc.Body, "javascript") {
+		t.Errorf("body kept a javascript: target: %q", doc.Body)
+	}
+	if !strings.Contains(doc.Body, "field") {
+		t.Errorf("field link text dropped from body %q", doc.Body)
+	}
+	if !strings.Contains(doc.Body, `<img src="https://theattic.us/cover.jpg"`) {
+		t.Errorf("https image missing from body %q", doc.Body)
+	}
+}
+
+func TestTitleLeftOutOfBody(t *testing.T) {
+	body := `<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>My Post</w:t></w:r></w:p>` +
+		`<w:p><w:pPr><w:pStyle w:val="Title"/></w:pPr><w:r><w:t>Second Title</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>Body text</w:t></w:r></w:p>`
+	doc := convertTestDocument(t, body, "")
+
+	if doc.Title != "My Post" {
+		t.Errorf("Title = %q, want %q", doc.Title, "My Post")
+	}
+	if strings.Contains(doc.Body, "My Post") {
+		t.Errorf("title repeated in body %q", doc.Body)
+	}
+	if !strings.Contains(doc.Body, "<h1>Second Title</h1>") || !strings.Contains(doc.Body, "<p>Body text</p>") {
+		t.Errorf("unexpected body %q", doc.Body)
+	}
+}
+
+// testStyles defines a heading style by name and another by outline level
+const testStyles = `<w:styles ` + testNamespaces + `>` +
+	`<w:style w:styleId="Heading2"><w:name w:val="heading 2"/></w:style>` +
+	`<w:style w:styleId="PullQuote"><w:name w:val="Pull Quote"/><w:pPr><w:outlineLvl w:val="2"/></w:pPr></w:style>` +
+	`</w:styles>`
+
+// testNumbering defines list 1, bulleted with numbered items below it, and list 2, numbered
+const testNumbering = `<w:numbering ` + testNamespaces + `>` +
+	`<w:abstractNum w:abstractNumId="10"><w:lvl w:ilvl="0"><w:numFmt w:val="bullet"/></w:lvl>` +
+	`<w:lvl w:ilvl="1"><w:numFmt w:val="decimal"/></w:lvl></w:abstractNum>` +
+	`<w:abstractNum w:abstractNumId="20"><w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl></w:abstractNum>` +
+	`<w:num w:numId="1"><w:abstractNumId w:val="10"/></w:num>` +
+	`<w:num w:numId="2"><w:abstractNumId w:val="20"/></w:num>` +
+	`</w:numbering>`
+
+// testParagraph is a paragraph of one run with the given paragraph and run properties
+func testParagraph(pPr string, rPr string, text string) string {
+	return `<w:p><w:pPr>` + pPr + `</w:pPr><w:r><w:rPr>` + rPr + `</w:rPr><w:t>` + text + `</w:t></w:r></w:p>`
+}
+
+// testListItem is a paragraph in list numID at level ilvl
+func testListItem(numID string, ilvl string, text string) string {
+	return testParagraph(`<w:numPr><w:ilvl w:val="`+ilvl+`"/><w:numId w:val="`+numID+`"/></w:numPr>`, "", text)
+}
+
+func TestConvertBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		/***********
+		* headings *
+		***********/
+
+		{"heading from style name", testParagraph(`<w:pStyle w:val="Heading2"/>`, "", "Intro"), "<h2>Intro</h2>\n"},
+		{"heading from style outline level", testParagraph(`<w:pStyle w:val="PullQuote"/>`, "", "Quote"), "<h3>Quote</h3>\n"},
+		{"heading from undefined style id", testParagraph(`<w:pStyle w:val="Heading4"/>`, "", "Deep"), "<h4>Deep</h4>\n"},
+		{"heading from paragraph outline level", testParagraph(`<w:outlineLvl w:val="0"/>`, "", "Top"), "<h1>Top</h1>\n"},
+		{"outline level overrides style", testParagraph(`<w:pStyle w:val="Heading2"/><w:outlineLvl w:val="4"/>`, "", "Five"),
+			"<h5>Five</h5>\n"},
+		{"body text outline level", testParagraph(`<w:outlineLvl w:val="9"/>`, "", "Plain"), "<p>Plain</p>\n"},
+
+		/*******
+		* runs *
+		*******/
+
+		{"bold", testParagraph("", `<w:b/>`, "bold"), "<p><strong>bold</strong></p>\n"},
+		{"bold switched off", testParagraph("", `<w:b w:val="0"/>`, "plain"), "<p>plain</p>\n"},
+		{"italic", testParagraph("", `<w:i/>`, "italic"), "<p><em>italic</em></p>\n"},
+		{"underline", testParagraph("", `<w:u w:val="single"/>`, "underlined"), "<p><u>underlined</u></p>\n"},
+		{"no underline", testParagraph("", `<w:u w:val="none"/>`, "plain"), "<p>plain</p>\n"},
+		{"strike", testParagraph("", `<w:strike/>`, "struck"), "<p><s>struck</s></p>\n"},
+		{"double strike", testParagraph("", `<w:dstrike/>`, "struck"), "<p><s>struck</s></p>\n"},
+		{"every format", testParagraph("", `<w:u w:val="single"/><w:strike/><w:i/><w:b/>`, "all"),
+			"<p><strong><em><u><s>all</s></u></em></strong></p>\n"},
+		{"adjacent runs share tags",
+			`<w:p><w:r><w:rPr><w:b/></w:rPr><w:t>a</w:t></w:r><w:r><w:rPr><w:b/><w:i/></w:rPr><w:t>b</w:t></w:r>` +
+				`<w:r><w:t>c</w:t></w:r></w:p>`,
+			"<p><strong>a<em>b</em></strong>c</p>\n"},
+
+		/********
+		* lists *
+		********/
+
+		{"bulleted list", testListItem("1", "0", "one") + testListItem("1", "0", "two"),
+			"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n"},
+		{"numbered list", testListItem("2", "0", "one") + testListItem("2", "0", "two"),
+			"<ol>\n<li>one</li>\n<li>two</li>\n</ol>\n"},
+		{"nested list", testListItem("1", "0", "one") + testListItem("1", "1", "one.a") + testListItem("1", "0", "two"),
+			"<ul>\n<li>one<ol>\n<li>one.a</li>\n</ol>\n</li>\n<li>two</li>\n</ul>\n"},
+		{"bulleted then numbered list", testListItem("1", "0", "bullet") + testListItem("2", "0", "number"),
+			"<ul>\n<li>bullet</li>\n</ul>\n<ol>\n<li>number</li>\n</ol>\n"},
+		{"list closed by a paragraph", testListItem("2", "0", "item") + testParagraph("", "", "after"),
+			"<ol>\n<li>item</li>\n</ol>\n<p>after</p>\n"},
+
+		/*********
+		* tables *
+		*********/
+
+		{"table",
+			`<w:tbl>` +
+				`<w:tr><w:trPr><w:tblHeader/></w:trPr><w:tc><w:p><w:r><w:t>Name</w:t></w:r></w:p></w:tc>` +
+				`<w:tc><w:p><w:r><w:t>Age</w:t></w:r></w:p></w:tc></w:tr>` +
+				`<w:tr><w:tc><w:p><w:r><w:t>Alice</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>30</w:t></w:r></w:p></w:tc></w:tr>` +
+				`</w:tbl>`,
+			"<table>\n<tr><th><p>Name</p>\n</th><th><p>Age</p>\n</th></tr>\n<tr><td><p>Alice</p>\n</td><td><p>30</p>\n</td></tr>\n</table>\n"},
+		{"table with merged cells",
+			`<w:tbl>` +
+				`<w:tr><w:tc><w:tcPr><w:gridSpan w:val="2"/></w:tcPr><w:p><w:r><w:t>wide</w:t></w:r></w:p></w:tc></w:tr>` +
+				`<w:tr><w:tc><w:tcPr><w:vMerge w:val="restart"/></w:tcPr><w:p><w:r><w:t>tall</w:t></w:r></w:p></w:tc>` +
+				`<w:tc><w:p><w:r><w:t>a</w:t></w:r></w:p></w:tc></w:tr>` +
+				`<w:tr><w:tc><w:tcPr><w:vMerge/></w:tcPr><w:p/></w:tc><w:tc><w:p><w:r><w:t>b</w:t></w:r></w:p></w:tc></w:tr>` +
+				`</w:tbl>`,
+			"<table>\n<tr><td colspan=\"2\"><p>wide</p>\n</td></tr>\n<tr><td rowspan=\"2\"><p>tall</p>\n</td><td><p>a</p>\n</td></tr>\n" +
+				"<tr><td><p>b</p>\n</td></tr>\n</table>\n"},
+	}
+
+	parts := map[string]string{"word/styles.xml": testStyles, "word/numbering.xml": testNumbering}
+	for _, test := range tests {
+		doc := convertTestParts(t, test.body, "", parts)
+		if doc.Body != test.want {
+			t.Errorf("%s: body is\n%q\nwant\n%q", test.name, doc.Body, test.want)
+		}
+	}
+}
+
+func TestEmbeddedImages(t *testing.T) {
+	drawing := func(relID string, alt string) string {
+		return `<w:p><w:r><w:drawing><inline><docPr descr="` + alt + `"/><graphic><blip r:embed="` + relID + `"/></graphic>` +
+			`</inline></w:drawing></w:r></w:p>`
+	}
+	body := drawing("rId1", "A beach") + drawing("rId2", "Another beach") + drawing("rId1", "The beach again") +
+		drawing("rId3", "Missing")
+	rels := `<Relationship Id="rId1" Type="image" Target="media/image1.png"/>` +
+		`<Relationship Id="rId2" Type="image" Target="/word/embeddings/image1.png"/>` +
+		`<Relationship Id="rId3" Type="image" Target="media/missing.png"/>`
+	doc := convertTestParts(t, body, rels, map[string]string{
+		"word/media/image1.png":      "first",
+		"word/embeddings/image1.png": "second",
+	})
+
+	tests := []struct {
+		src string
+		alt string
+	}{
+		{"images/image1.png", "A beach"},
+		{"images/image1-2.png", "Another beach"},
+		{"images/image1.png", "The beach again"},
+	}
+	for _, test := range tests {
+		if img := `<img src="` + test.src + `" alt="` + test.alt + `">`; !strings.Contains(doc.Body, img) {
+			t.Errorf("body is missing %s: %q", img, doc.Body)
+		}
+	}
+	if strings.Contains(doc.Body, "missing") {
+		t.Errorf("body links a missing image: %q", doc.Body)
+	}
+
+	want := []Image{{Name: "image1.png", Data: []byte("first")}, {Name: "image1-2.png", Data: []byte("second")}}
+	if len(doc.Images) != len(want) {
+		t.Fatalf("%d images, want %d", len(doc.Images), len(want))
+	}
+	for i, image := range doc.Images {
+		if image.Name != want[i].Name || !bytes.Equal(image.Data, want[i].Data) {
+			t.Errorf("image %d is %s holding %q, want %s holding %q", i, image.Name, image.Data, want[i].Name, want[i].Data)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// driveSource reads posts from the Google Drive folder named by drive.root-folder
+type driveSource struct {
+	cfg     *Config
+	service *drive.Service
+}
+
+// newDriveSource authorizes with the configured OAuth credentials and connects to Drive
+func newDriveSource(cfg *Config) (*driveSource, error) {
+	b, err := ioutil.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read client secret file: %s", err.Error())
+	}
+
+	// If modifying these scopes, delete your previously saved token.json.
+	config, err := google.ConfigFromJSON(b, drive.DriveReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse client secret file to conf: %s", err.Error())
+	}
+	client := getClient(config, cfg.TokenFile)
+	client.Transport = &meteredTransport{base: client.Transport}
+	client.CheckRedirect = func(r *http.Request, via []*http.Request) error {
+		r.URL.Opaque = r.URL.Path
+		return nil
+	}
+
+	logrus.Info("Initializing drive service...")
+	service, err := drive.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Drive client: %s", err.Error())
+	}
+	logrus.Info("Successfully initialized drive service")
+
+	return &driveSource{
+		cfg:     cfg,
+		service: service,
+	}, nil
+}
+
+func (s *driveSource) ListAuthors() ([]SourceFile, error) {
+	folder, err := s.findRootFolder()
+	if err != nil {
+		return nil, err
+	}
+
+	authorFolders, err := s.listFiles(
+		fmt.Sprintf("mimeType = '%s' and '%s' in parents and trashed = false", folderMime, folder.Id),
+		"id, name")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting list of author folders: %s", err.Error())
+	}
+	return sourceFiles(authorFolders), nil
+}
+
+func (s *driveSource) ListPosts(author SourceFile) ([]SourceFile, error) {
+	dateFolders, err := s.listFiles(
+		fmt.Sprintf("mimeType = '%s' and '%s' in parents and trashed = false", folderMime, author.ID),
+		"id, name")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing post folders for author '%s': %s", author.Name, err.Error())
+	}
+	return sourceFiles(dateFolders), nil
+}
+
+func (s *driveSource) ListPostFiles(date SourceFile) ([]SourceFile, []SourceFile, error) {
+	postFiles, err := s.listFiles(
+		fmt.Sprintf("(mimeType = '%s' or mimeType = '%s') and '%s' in parents and trashed = false", docxMime, googleDocMime, date.ID),
+		"id, name, mimeType, fileExtension, md5Checksum, version")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error retrieving post file: %s", err.Error())
+	}
+
+	var mimeQuery []string
+	for _, m := range imageMimes {
+		mimeQuery = append(mimeQuery, fmt.Sprintf("mimeType = '%s'", m))
+	}
+	imageFiles, err := s.listFiles(
+		fmt.Sprintf("(%s) and '%s' in parents and trashed = false", strings.Join(mimeQuery, " or "), date.ID),
+		"id, name, mimeType, md5Checksum, properties")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error retrieving image files: %s", err.Error())
+	}
+
+	return sourceFiles(postFiles), sourceFiles(imageFiles), nil
+}
+
+func (s *driveSource) FetchDocument(document SourceFile) ([]byte, error) {
+	return s.download(document.ID, document.MimeType)
+}
+
+func (s *driveSource) FetchImage(image SourceFile) ([]byte, error) {
+	return s.download(image.ID, image.MimeType)
+}
+
+// Watch opens a new notification channel on the document's Drive file
+func (s *driveSource) Watch(document SourceFile) (*Channel, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expiration := time.Now().Add(s.cfg.Drive.ChannelTTL)
+	channel := &drive.Channel{
+		Kind:       "api#channel",
+		Id:         generateHash(10),
+		Expiration: expiration.UnixNano() / 1000000,
+		ResourceId: document.ID,
+		Token:      token,
+		Type:       "web_hook",
+		Address:    s.cfg.WebhookAddress,
+		Payload:    true,
+	}
+
+	returnedChannel, err := s.service.Files.Watch(document.ID, channel).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error watching file '%s': %s", document.ID, err.Error())
+	}
+	if returnedChannel.Expiration == 0 { // drive doesn't always echo the expiration back
+		returnedChannel.Expiration = channel.Expiration
+	}
+
+	return &Channel{
+		ID:         returnedChannel.Id,
+		ResourceID: returnedChannel.ResourceId,
+		Token:      token,
+		Expiration: channelExpiry(returnedChannel),
+	}, nil
+}
+
+func (s *driveSource) StopWatch(channel *Channel) error {
+	return s.service.Channels.Stop(&drive.Channel{Id: channel.ID, ResourceId: channel.ResourceID}).Do()
+}
+
+const changeFields = "nextPageToken, newStartPageToken, changes(fileId, removed, file(id, name, mimeType, parents, trashed, fileExtension, md5Checksum, version, properties))"
+
+func (s *driveSource) RootFolderID() (string, error) {
+	folder, err := s.findRootFolder()
+	if err != nil {
+		return "", err
+	}
+	return folder.Id, nil
+}
+
+func (s *driveSource) StartPageToken() (string, error) {
+	r, err := s.service.Changes.GetStartPageToken().Do()
+	if err != nil {
+		return "", fmt.Errorf("Error getting changes start page token: %s", err.Error())
+	}
+	return r.StartPageToken, nil
+}
+
+func (s *driveSource) ListChanges(pageToken string) (*ChangePage, error) {
+	r, err := s.service.Changes.List(pageToken).IncludeRemoved(true).PageSize(int64(s.cfg.Drive.PageSize)).Fields(changeFields).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing changes: %s", err.Error())
+	}
+
+	page := &ChangePage{
+		NextPageToken:     r.NextPageToken,
+		NewStartPageToken: r.NewStartPageToken,
+	}
+	for _, change := range r.Changes {
+		converted := FeedChange{FileID: change.FileId, Removed: change.Removed}
+		if change.File != nil {
+			converted.File = feedFile(change.File)
+		}
+		page.Changes = append(page.Changes, converted)
+	}
+	return page, nil
+}
+
+func (s *driveSource) GetFolder(id string) (*FeedFile, error) {
+	folder, err := s.service.Files.Get(id).Fields("id, name, mimeType, parents").Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting folder '%s': %s", id, err.Error())
+	}
+	return feedFile(folder), nil
+}
+
+// WatchChanges opens a new notification channel on the changes feed
+func (s *driveSource) WatchChanges(pageToken string) (*Channel, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	channel := &drive.Channel{
+		Kind:       "api#channel",
+		Id:         generateHash(10),
+		Expiration: time.Now().Add(s.cfg.Drive.ChannelTTL).UnixNano() / 1000000,
+		Token:      token,
+		Type:       "web_hook",
+		Address:    s.cfg.WebhookAddress,
+		Payload:    true,
+	}
+
+	returnedChannel, err := s.service.Changes.Watch(pageToken, channel).IncludeRemoved(true).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Error watching changes: %s", err.Error())
+	}
+	if returnedChannel.Expiration == 0 {
+		returnedChannel.Expiration = channel.Expiration
+	}
+
+	return &Channel{
+		ID:         returnedChannel.Id,
+		ResourceID: returnedChannel.ResourceId,
+		Token:      token, // kept to verify notifications, whether or not drive echoes it back
+		Expiration: channelExpiry(returnedChannel),
+	}, nil
+}
+
+// findRootFolder looks up the Drive folder that holds every author's folder
+func (s *driveSource) findRootFolder() (*drive.File, error) {
+	folders, err := s.listFiles(
+		fmt.Sprintf("mimeType = '%s' and name = '%s' and trashed = false", folderMime, s.cfg.Drive.RootFolder),
+		"id, name")
+	if err != nil {
+		return nil, fmt.Errorf("Error querying google drive for posts folder: %s", err.Error())
+	}
+
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("%s folder not found", s.cfg.Drive.RootFolder)
+	}
+	if len(folders) > 1 {
+		logrus.WithField("count", len(folders)).Warn("Found more than one posts folder, using the first")
+	}
+
+	logrus.WithField("folder", s.cfg.Drive.RootFolder).Debug("Found posts folder")
+	return folders[0], nil
+}
+
+// listFiles runs a Files.List query and follows nextPageToken until every matching file has been returned. fields
+// selects the fields returned for each file.
+func (s *driveSource) listFiles(query string, fields string) ([]*drive.File, error) {
+	var files []*drive.File
+	pages, firstPage := 0, 0
+	err := s.service.Files.List().
+		Q(query).
+		PageSize(int64(s.cfg.Drive.PageSize)).
+		Fields(googleapi.Field(fmt.Sprintf("nextPageToken, files(%s)", fields))).
+		Pages(context.Background(), func(r *drive.FileList) error {
+			files = append(files, r.Files...)
+			if pages == 0 {
+				firstPage = len(r.Files)
+			}
+			pages++
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// report how much a single-page listing would have missed
+	if pages > 1 {
+		truncated := len(files) - firstPage
+		driveListsTruncated.Inc()
+		driveListTruncatedFiles.Add(float64(truncated))
+		logrus.WithFields(logrus.Fields{
+			"query":     query,
+			"pages":     pages,
+			"files":     len(files),
+			"firstPage": firstPage,
+			"truncated": truncated,
+		}).Info("Listing needed more than one page")
+	}
+
+	return files, nil
+}
+
+func (s *driveSource) download(fileID string, mimeType string) ([]byte, error) {
+	log := logrus.WithFields(logrus.Fields{
+		"fileID":   fileID,
+		"mimeType": mimeType,
+	})
+
+	var resp *http.Response
+	var err error
+	switch {
+	case mimeType == docxMime || isImageMime(mimeType): // download docx and images directly
+		resp, err = s.service.Files.Get(fileID).Download()
+	case mimeType == googleDocMime: // export google doc files as docx
+		resp, err = s.service.Files.Export(fileID, docxMime).Download()
+	default:
+		return nil, fmt.Errorf("unsupported mime type: %s", mimeType)
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to fetch file from Google Drive")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.WithError(err).Error("Failed to read response body")
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := fmt.Errorf("Got non-2XX status code from Google Drive")
+
+		var getError driveFileGetError
+		err2 := json.Unmarshal(body, &getError)
+		if err2 != nil {
+			log.WithError(err2).Error("Error unmarshalling json body into error")
+			return nil, err
+		}
+
+		log.WithFields(logrus.Fields{
+			"status code": resp.StatusCode,
+			"json error":  err,
+		}).Error(err)
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// channelExpiry returns when a Drive channel stops delivering notifications
+func channelExpiry(channel *drive.Channel) time.Time {
+	return time.Unix(0, channel.Expiration*int64(time.Millisecond))
+}
+
+func sourceFile(file *drive.File) SourceFile {
+	converted := SourceFile{
+		ID:            file.Id,
+		Name:          file.Name,
+		MimeType:      file.MimeType,
+		FileExtension: file.FileExtension,
+		Checksum:      file.Md5Checksum,
+		Cover:         file.Properties[coverProperty] == "true",
+	}
+	if converted.Checksum == "" && file.Version != 0 { // google docs have no md5, but their version goes up with every edit
+		converted.Checksum = fmt.Sprintf("version:%d", file.Version)
+	}
+	return converted
+}
+
+func feedFile(file *drive.File) *FeedFile {
+	return &FeedFile{
+		SourceFile: sourceFile(file),
+		Parents:    file.Parents,
+		Trashed:    file.Trashed,
+	}
+}
+
+func sourceFiles(files []*drive.File) []SourceFile {
+	converted := make([]SourceFile, 0, len(files))
+	for _, file := range files {
+		converted = append(converted, sourceFile(file))
+	}
+	return converted
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	homepageNative = "native"
+	homepageScript = "script"
+)
+
+// homepageTemplate is the template in the template directory that renders each index page. Every other *.html file
+// in the directory is parsed along with it, so it can use them as partials.
+const homepageTemplate = "index.html"
+
+// defaultHomepageTemplate is used when no homepage.template-dir is configured
+const defaultHomepageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>The Attic</title>
+</head>
+<body>
+<main>
+{{range .Posts}}<article>
+<a href="{{.URL}}"><img src="{{.Thumbnail}}" alt="{{.Title}}"></a>
+<h2><a href="{{.URL}}">{{.Title}}</a></h2>
+<p class="byline">{{.Author}}, {{.Date}}</p>
+</article>
+{{end}}</main>
+<nav>
+{{if .PrevURL}}<a href="{{.PrevURL}}">Newer posts</a>{{end}}
+{{if .NextURL}}<a href="{{.NextURL}}">Older posts</a>{{end}}
+</nav>
+</body>
+</html>
+`
+
+// homepage is the data each index page is rendered with
+type homepage struct {
+	Posts      []homepagePost
+	Page       int // starting at 1
+	TotalPages int
+	PrevURL    string // empty on the first page
+	NextURL    string // empty on the last page
+}
+
+type homepagePost struct {
+	Author     string
+	Date       string
+	Title      string
+	URL        string
+	Thumbnail  string            // the first configured thumbnail size
+	Thumbnails map[string]string // every thumbnail size, by name
+	Images     []string          // the post's gallery images
+}
+
+// generateHomepage rebuilds the site's index pages. The native generator falls back to the homepage script, if one
+// is configured, when it fails.
+func generateHomepage(cfg *Config, posts *PostRegistry, steps *buildSteps, log *logrus.Entry) error {
+	defer observeStage(stageHomepage, time.Now())
+
+	if cfg.Homepage.Generator == homepageNative {
+		started := time.Now()
+		err := generateHomepageNative(cfg, posts, log)
+		steps.step(stageHomepage, started, err)
+		if err == nil || cfg.Scripts.Homepage == "" {
+			return err
+		}
+		log.WithError(err).Warn("Native homepage generation failed, falling back to homepage script")
+	}
+
+	return generateHomepageScript(cfg, steps, log)
+}
+
+func generateHomepageNative(cfg *Config, posts *PostRegistry, log *logrus.Entry) error {
+	tmpl, err := loadHomepageTemplates(cfg)
+	if err != nil {
+		log.WithError(err).Error("Error loading homepage templates")
+		return err
+	}
+
+	entries := homepagePosts(cfg, posts.snapshots())
+	pageSize := cfg.Homepage.PageSize
+	if pageSize == 0 || pageSize > len(entries) { // everything fits on one page
+		pageSize = len(entries)
+	}
+	totalPages := 1
+	if pageSize > 0 {
+		totalPages = (len(entries) + pageSize - 1) / pageSize
+	}
+
+	log.WithFields(logrus.Fields{
+		"posts": len(entries),
+		"pages": totalPages,
+	}).Info("Generating homepage")
+
+	/**************************
+	* render every index page *
+	**************************/
+
+	for page := 1; page <= totalPages; page++ {
+		start := (page - 1) * pageSize
+		end := start + pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		data := homepage{
+			Posts:      entries[start:end],
+			Page:       page,
+			TotalPages: totalPages,
+		}
+		if page > 1 {
+			data.PrevURL = homepageURL(page - 1)
+		}
+		if page < totalPages {
+			data.NextURL = homepageURL(page + 1)
+		}
+
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, homepageTemplate, data); err != nil {
+			log.WithError(err).WithField("page", page).Error("Error rendering homepage")
+			return err
+		}
+
+		path := homepagePath(cfg, page)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			log.WithError(err).Error("Error creating homepage directory")
+			return err
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0664); err != nil {
+			log.WithError(err).WithField("path", path).Error("Error saving homepage")
+			return err
+		}
+	}
+
+	removeStaleHomepages(cfg, totalPages, log)
+
+	log.Debug("Successfully generated homepage")
+	return nil
+}
+
+func generateHomepageScript(cfg *Config, steps *buildSteps, log *logrus.Entry) error {
+	script := cfg.Scripts.Homepage
+
+	log.WithField("cmd", script).Info("Running script to generate homepage")
+
+	stdout, stderr, err := steps.command("homepage script", exec.Command(script))
+	if err != nil {
+		log.WithError(err).WithField("stderr", stderr).Error("Failed to run script to generate homepage")
+		return err
+	}
+
+	log.WithField("stdout", stdout).Debug("Successfully ran script to generate homepage")
+	return nil
+}
+
+// homepagePosts lists the posts newest first. Posts from the same date are ordered by author, then title, so the
+// pages come out the same every time.
+func homepagePosts(cfg *Config, posts []Post) []homepagePost {
+	entries := make([]homepagePost, 0, len(posts))
+	for _, post := range posts {
+		base := fmt.Sprintf("/%s/%s/%s/", cfg.HTML.PostsDir, url.PathEscape(post.Author), url.PathEscape(post.Date))
+		entry := homepagePost{
+			Author:     post.Author,
+			Date:       post.Date,
+			Title:      postTitle(post),
+			URL:        base,
+			Thumbnails: make(map[string]string),
+			Images:     []string{},
+		}
+		for _, image := range postGallery(cfg, post) {
+			entry.Images = append(entry.Images, base+image.URL)
+		}
+		for i, size := range cfg.Thumbnail.Sizes {
+			entry.Thumbnails[size.Name] = base + size.Name + ".jpg"
+			if i == 0 {
+				entry.Thumbnail = entry.Thumbnails[size.Name]
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Date != b.Date {
+			return a.Date > b.Date
+		}
+		if a.Author != b.Author {
+			return a.Author < b.Author
+		}
+		return a.Title < b.Title
+	})
+	return entries
+}
+
+// loadHomepageTemplates parses the template directory, read fresh each time so it can be edited without a restart
+func loadHomepageTemplates(cfg *Config) (*template.Template, error) {
+	if cfg.Homepage.TemplateDir == "" {
+		return template.New(homepageTemplate).Parse(defaultHomepageTemplate)
+	}
+
+	tmpl, err := template.ParseGlob(filepath.Join(cfg.Homepage.TemplateDir, "*.html"))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing homepage templates: %s", err.Error())
+	}
+	if tmpl.Lookup(homepageTemplate) == nil {
+		return nil, fmt.Errorf("Homepage template directory has no %s", homepageTemplate)
+	}
+	return tmpl, nil
+}
+
+// homepagePath is where an index page is written: index.html for the first page, page/<n>/index.html for the rest
+func homepagePath(cfg *Config, page int) string {
+	if page == 1 {
+		return filepath.Join(cfg.HTML.OutputDir, "index.html")
+	}
+	return filepath.Join(cfg.HTML.OutputDir, "page", strconv.Itoa(page), "index.html")
+}
+
+func homepageURL(page int) string {
+	if page == 1 {
+		return "/"
+	}
+	return fmt.Sprintf("/page/%d/", page)
+}
+
+// removeStaleHomepages deletes index pages left over from when there were more pages
+func removeStaleHomepages(cfg *Config, totalPages int, log *logrus.Entry) {
+	dir := filepath.Join(cfg.HTML.OutputDir, "page")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return // no page directory yet
+	}
+
+	for _, entry := range entries {
+		page, err := strconv.Atoi(entry.Name())
+		if err != nil || page <= totalPages {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			log.WithError(err).WithField("page", page).Warn("Error removing stale homepage")
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sourceDrive = "drive"
+	sourceLocal = "local"
+)
+
+// localSettleDelay is how long a post folder has to be quiet before its changes are handled. Saving a document
+// usually shows up as several events, and the first of them can arrive before the file is completely written.
+const localSettleDelay = 2 * time.Second
+
+// localSource reads posts from a local directory laid out like the Drive folder, <root>/<author>/<date>/, and
+// watches it with inotify. File and folder IDs are slash separated paths relative to the root directory.
+type localSource struct {
+	root    string
+	watcher *fsnotify.Watcher
+
+	lock     sync.Mutex
+	channels map[string]*Channel        // by channel ID
+	pending  map[string]map[string]bool // folder ID -> names of changed files, waiting to settle
+	timers   map[string]*time.Timer     // folder ID -> settle timer
+	onChange func(folderID string, names []string)
+}
+
+// newLocalSource starts watching every folder under the root directory. Changes are held back until start is called.
+func newLocalSource(cfg *Config) (*localSource, error) {
+	info, err := os.Stat(cfg.Local.RootDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening local posts directory: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Local posts directory '%s' is not a directory", cfg.Local.RootDir)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file watcher: %s", err.Error())
+	}
+	s := &localSource{
+		root:     cfg.Local.RootDir,
+		watcher:  watcher,
+		channels: make(map[string]*Channel),
+		pending:  make(map[string]map[string]bool),
+		timers:   make(map[string]*time.Timer),
+	}
+	if err := s.watchTree(s.root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	logrus.WithField("root", s.root).Info("Watching local posts directory")
+	return s, nil
+}
+
+func (s *localSource) ListAuthors() ([]SourceFile, error) {
+	return s.list("", true)
+}
+
+func (s *localSource) ListPosts(author SourceFile) ([]SourceFile, error) {
+	return s.list(author.ID, true)
+}
+
+func (s *localSource) ListPostFiles(date SourceFile) ([]SourceFile, []SourceFile, error) {
+	files, err := s.list(date.ID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var documents, images []SourceFile
+	for _, file := range files {
+		switch {
+		case file.MimeType == docxMime:
+			documents = append(documents, file)
+		case isImageMime(file.MimeType):
+			images = append(images, file)
+		}
+	}
+	return documents, images, nil
+}
+
+func (s *localSource) FetchDocument(document SourceFile) ([]byte, error) {
+	return ioutil.ReadFile(s.path(document.ID))
+}
+
+func (s *localSource) FetchImage(image SourceFile) ([]byte, error) {
+	return ioutil.ReadFile(s.path(image.ID))
+}
+
+// Watch registers a channel for the document. Every folder is watched already, so this is only bookkeeping.
+func (s *localSource) Watch(document SourceFile) (*Channel, error) {
+	if _, err := os.Stat(s.path(document.ID)); err != nil {
+		return nil, fmt.Errorf("Error watching file '%s': %s", document.ID, err.Error())
+	}
+
+	channel := &Channel{
+		ID:         generateHash(10),
+		ResourceID: document.ID,
+	}
+	s.lock.Lock()
+	s.channels[channel.ID] = channel
+	s.lock.Unlock()
+	return channel, nil
+}
+
+func (s *localSource) StopWatch(channel *Channel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.channels, channel.ID)
+	return nil
+}
+
+// start calls onChange with the names of the changed files each time a post folder settles after changing. Changes
+// to the folder itself, like it being created, are reported with no names.
+func (s *localSource) start(onChange func(folderID string, names []string)) {
+	s.lock.Lock()
+	s.onChange = onChange
+	s.lock.Unlock()
+
+	go s.run()
+}
+
+// close stops watching the directory
+func (s *localSource) close() error {
+	return s.watcher.Close()
+}
+
+// path returns the local path of a file or folder ID
+func (s *localSource) path(id string) string {
+	return filepath.Join(s.root, filepath.FromSlash(id))
+}
+
+// list returns the folders, or the files, directly inside a folder, ordered by name. Hidden files and the lock and
+// temporary files editors leave next to documents are skipped.
+func (s *localSource) list(folderID string, folders bool) ([]SourceFile, error) {
+	entries, err := ioutil.ReadDir(s.path(folderID))
+	if err != nil {
+		return nil, fmt.Errorf("Error listing local folder '%s': %s", folderID, err.Error())
+	}
+
+	var files []SourceFile
+	for _, entry := range entries {
+		if ignoredLocalName(entry.Name()) || entry.IsDir() != folders || folders && !validFolderName(entry.Name()) {
+			continue
+		}
+		file := SourceFile{
+			ID:   path.Join(folderID, entry.Name()),
+			Name: entry.Name(),
+		}
+		if folders {
+			file.MimeType = folderMime
+		} else {
+			file.FileExtension = strings.TrimPrefix(strings.ToLower(filepath.Ext(entry.Name())), ".")
+			file.MimeType = localMimeType(file.FileExtension)
+			if file.MimeType != "" {
+				if file.Checksum, err = fileChecksum(s.path(file.ID)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// fileChecksum returns the hex md5 of a file's content, matching the checksums Drive reports
+func fileChecksum(p string) (string, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("Error reading local file '%s': %s", p, err.Error())
+	}
+	return fmt.Sprintf("%x", md5.Sum(b)), nil
+}
+
+func localMimeType(extension string) string {
+	switch extension {
+	case "docx":
+		return docxMime
+	case "jpg", "jpeg":
+		return jpegMime
+	case "png":
+		return pngMime
+	case "webp":
+		return webpMime
+	case "gif":
+		return gifMime
+	case "heic":
+		return heicMime
+	case "heif":
+		return heifMime
+	}
+	return ""
+}
+
+func ignoredLocalName(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~")
+}
+
+/*******************
+* inotify watching *
+*******************/
+
+// watchTree watches a folder and every folder below it, down to the date folders
+func (s *localSource) watchTree(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) { // removed while walking
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p != dir && (ignoredLocalName(info.Name()) || !validFolderName(info.Name())) || len(s.split(p)) > 2 {
+			return filepath.SkipDir
+		}
+		if err := s.watcher.Add(p); err != nil {
+			return fmt.Errorf("Error watching local folder '%s': %s", p, err.Error())
+		}
+		return nil
+	})
+}
+
+// split returns the parts of a path below the root directory: author, date and file name
+func (s *localSource) split(p string) []string {
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil || rel == "." {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
+
+func (s *localSource) run() {
+	for {
+		select {
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			s.handleEvent(event)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Error("Error watching local posts directory")
+		}
+	}
+}
+
+func (s *localSource) handleEvent(event fsnotify.Event) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	parts := s.split(event.Name)
+	if len(parts) == 0 || ignoredLocalName(parts[len(parts)-1]) {
+		return
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"path": event.Name,
+		"op":   event.Op.String(),
+	})
+	log.Debug("Local posts directory changed")
+
+	// new author and date folders need watching too, along with anything created in them before the watch
+	if event.Has(fsnotify.Create) && len(parts) <= 2 {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			if err := s.watchTree(event.Name); err != nil {
+				log.WithError(err).Error("Error watching new local folder")
+			}
+		}
+	}
+
+	var folderID, name string
+	switch len(parts) {
+	case 1: // an author folder; its date folders report their own changes
+		return
+	case 2:
+		folderID = path.Join(parts[0], parts[1])
+	case 3:
+		folderID, name = path.Join(parts[0], parts[1]), parts[2]
+	default:
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pending[folderID] == nil {
+		s.pending[folderID] = make(map[string]bool)
+	}
+	if name != "" {
+		s.pending[folderID][name] = true
+	}
+	s.schedule(folderID)
+}
+
+// schedule (re)starts the folder's settle timer. Callers hold the lock.
+func (s *localSource) schedule(folderID string) {
+	if timer, ok := s.timers[folderID]; ok {
+		timer.Stop()
+	}
+	s.timers[folderID] = time.AfterFunc(localSettleDelay, func() {
+		s.lock.Lock()
+		changed := s.pending[folderID]
+		delete(s.pending, folderID)
+		delete(s.timers, folderID)
+		onChange := s.onChange
+		s.lock.Unlock()
+
+		names := make([]string, 0, len(changed))
+		for name := range changed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		onChange(folderID, names)
+	})
+}
+
+/*****************************
+* apply local folder changes *
+*****************************/
+
+// followLocalChanges rebuilds posts as their local folders change, picking up new posts with a rescan and
+// forgetting posts whose folders are deleted
+func followLocalChanges(cfg *Config, src *localSource, store *stateStore, posts *PostRegistry, updates *updateScheduler) {
+	src.start(func(folderID string, names []string) {
+		log := logrus.WithFields(logrus.Fields{
+			"folder": folderID,
+			"files":  names,
+		})
+
+		post := posts.inFolder(folderID)
+		if post == nil {
+			result, err := rescanPosts(cfg, src, store, posts, updates)
+			if err != nil {
+				log.WithError(err).Error("Error rescanning posts after local change")
+				return
+			}
+			log.WithFields(logrus.Fields{
+				"added":   len(result.Added),
+				"removed": len(result.Removed),
+			}).Debug("Rescanned posts after local change")
+			return
+		}
+
+		if _, err := os.Stat(src.path(folderID)); os.IsNotExist(err) {
+			forgetPost(src, store, posts, post)
+			return
+		}
+		if err := reloadPost(cfg, src, posts, post, names); err != nil {
+			log.WithError(err).WithField("post", post).Error("Error reloading changed post")
+			return
+		}
+		updates.schedule(post)
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFollowLocalChangesForgetsDeletedPost(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Local.RootDir = tempDir(t)
+	for _, date := range []string{"2021-01-02", "2021-02-03"} {
+		writeTree(t, cfg.Local.RootDir, map[string]string{
+			"alice/" + date + "/My Post.docx": string(testDocument(t, "body")),
+			"alice/" + date + "/cover.png":    string(testImage(t, color.White)),
+		})
+	}
+
+	src, err := newLocalSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.close()
+	updates := newUpdateScheduler(cfg, func(post *Post) {})
+	defer updates.stop()
+	posts := newPostRegistry()
+	if _, err := rescanPosts(cfg, src, nil, posts, updates); err != nil {
+		t.Fatal(err)
+	}
+	if posts.len() != 2 {
+		t.Fatalf("%d posts tracked, want 2", posts.len())
+	}
+	followLocalChanges(cfg, src, nil, posts, updates)
+
+	if err := os.RemoveAll(filepath.Join(cfg.Local.RootDir, "alice", "2021-01-02")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(localSettleDelay + 5*time.Second)
+	for posts.find("alice", "2021-01-02") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("post is still tracked after its folder was deleted")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if posts.find("alice", "2021-02-03") == nil {
+		t.Error("the other post was forgotten too")
+	}
+}
@@ -1,27 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
 )
 
+// Post is a post being followed. Author, Date and FolderID never change; the PostRegistry holding the post describes
+// how the rest of its fields are shared, and lock is held while the post is updated from the source or built.
 type Post struct {
 	Author        string
 	Date          string
+	FolderID      string
 	FileName      string
 	FileExtension string
 	FileID        string
@@ -29,11 +32,39 @@ type Post struct {
 	LastUpdated   time.Time
 	postPath      string
 	imagePath     string
-	Channel       *drive.Channel
-	image         *drive.File
+	Channel       *Channel
+	oldChannel    *Channel // the channel being replaced while Channel is renewed
+	checksum      string   // of the document, as listed by the source
+	lastBuild     *buildResult
+	image         SourceFile   // the cover image
+	gallery       []SourceFile // the folder's other images, by name
 	lock          *sync.Mutex
 }
 
+// String and MarshalJSON log a post as the fields that never change, so logging it doesn't race with updates
+func (post *Post) String() string {
+	return fmt.Sprintf("%s/%s", post.Author, post.Date)
+}
+
+func (post *Post) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Author   string
+		Date     string
+		FolderID string
+	}{post.Author, post.Date, post.FolderID})
+}
+
+// document returns the post's document as a SourceFile
+func (post *Post) document() SourceFile {
+	return SourceFile{
+		ID:            post.FileID,
+		Name:          post.FileName,
+		MimeType:      post.MimeType,
+		FileExtension: post.FileExtension,
+		Checksum:      post.checksum,
+	}
+}
+
 const DEBUG = false
 
 func main() {
@@ -47,186 +78,454 @@ func main() {
 	logrus.Info("Starting up update-posts")
 	logrus.Info("Successfully set up logger")
 
-	b, err := ioutil.ReadFile("/home/grish/update-posts/credentials.json")
+	cfg, err := loadConfig(os.Args[1:])
 	if err != nil {
-		logrus.WithError(err).Fatal("Unable to read client secret file")
+		logrus.WithError(err).Fatal("Invalid configuration")
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, drive.DriveReadonlyScope)
+	store, err := openStateStore(cfg.StateFile)
 	if err != nil {
-		logrus.WithError(err).Fatal("Unable to parse client secret file to conf")
-	}
-	driveClient = getClient(config)
-	driveClient.CheckRedirect = func(r *http.Request, via []*http.Request) error {
-		r.URL.Opaque = r.URL.Path
-		return nil
+		logrus.WithError(err).Fatal("Failed to open state file, exiting")
 	}
 
-	logrus.Info("Initializing drive service...")
-	driveService, err = drive.New(driveClient)
-	if err != nil {
-		logrus.WithError(err).Fatal("Unable to retrieve Drive client")
+	var src Source
+	var changes *changeWatcher
+	var localSrc *localSource
+	switch cfg.Source {
+	case sourceDrive:
+		driveSrc, err := newDriveSource(cfg)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to connect to Google Drive, exiting")
+		}
+		src = driveSrc
+
+		// the page token is fetched before walking the posts so no change made during the walk is missed
+		if cfg.Drive.WatchMode == watchModeChanges {
+			changes, err = newChangeWatcher(cfg, driveSrc, store)
+			if err != nil {
+				logrus.WithError(err).Fatal("Failed to get changes page token, exiting")
+			}
+		}
+	case sourceLocal:
+		// likewise the directory is watched before it's walked
+		localSrc, err = newLocalSource(cfg)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to watch local posts directory, exiting")
+		}
+		src = localSrc
 	}
-	logrus.Info("Successfully initialized drive service")
 
-	posts, err := subscribeToPosts()
+	posts, err := subscribeToPosts(cfg, src, store)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to subscribe to posts, exiting")
 	}
-	startHTTPListener(posts)
+	site := newSitePublisher(cfg, posts)
+	queue := newBuildQueue(cfg.Build.Workers, site.flush)
+	updates := newUpdateScheduler(cfg, func(post *Post) {
+		queue.enqueue(post, jobUpdate, func() error {
+			if err := refreshPost(cfg, src, store, posts, post); err != nil {
+				return err
+			}
+			site.request()
+			return nil
+		})
+	})
+
+	var channels *channelManager
+	switch {
+	case localSrc != nil:
+		followLocalChanges(cfg, localSrc, store, posts, updates)
+	case changes != nil:
+		if err := changes.start(posts, updates); err != nil {
+			logrus.WithError(err).Fatal("Failed to watch for changes, exiting")
+		}
+	default:
+		channels = newChannelManager(cfg, src, store, posts)
+		go channels.run()
+	}
+	if cfg.Drive.RescanInterval > 0 {
+		go runPeriodicRescan(cfg, src, store, posts, updates)
+	}
+
+	prometheus.MustRegister(newChannelCollector(posts, changes))
+	webhooks := new(webhookGate)
+	stop := make(chan struct{}, 1)
+	server, adminServer := startHTTPListener(cfg, src, store, posts, updates, queue, site, changes, webhooks, stop)
+
+	waitForShutdown(stop)
+	(&shutdown{
+		cfg:      cfg,
+		server:   server,
+		admin:    adminServer,
+		webhooks: webhooks,
+		src:      src,
+		local:    localSrc,
+		store:    store,
+		posts:    posts,
+		updates:  updates,
+		queue:    queue,
+		site:     site,
+		channels: channels,
+		changes:  changes,
+	}).run()
 }
 
-func subscribeToPosts() (map[string]*Post, error) {
+// subscribeToPosts watches and builds every post in the source. Saved channels still watching a post are reused, and
+// posts that haven't changed since their last successful build aren't built again.
+func subscribeToPosts(cfg *Config, src Source, store *stateStore) (*PostRegistry, error) {
+	saved, err := store.load()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithField("posts", len(saved)).Info("Loaded saved state")
+
 	logrus.Debug("Getting lists of files to subscribe to")
-	r, err := driveService.Files.List().
-		Q("mimeType = 'application/vnd.google-apps.folder' and name = 'attic-posts'").
-		PageSize(1).Fields("nextPageToken, files(id, name)").Do()
+	folders, err := listPostFolders(src)
 	if err != nil {
-		return nil, fmt.Errorf("Error querying google drive for posts folder: %s", err.Error())
+		return nil, err
+	}
+
+	posts := newPostRegistry()
+	for _, folder := range folders {
+		post, err := loadPost(src, folder.author, folder.date)
+		if err != nil {
+			// the periodic rescan tries again; until then whatever was saved for the folder is kept
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"author": folder.author,
+				"folder": folder.date.Name,
+			}).Error("Error loading post, skipping it")
+			delete(saved, folder.date.ID)
+			continue
+		}
+		if post == nil {
+			continue
+		}
+		stored := saved[post.FolderID]
+		delete(saved, post.FolderID)
+
+		if channel := stored.resumeChannel(cfg, post); channel != nil {
+			post.Channel = channel
+			posts.add(channel.ID, post)
+
+			logrus.WithFields(logrus.Fields{
+				"channel id": channel.ID,
+				"expiration": channel.Expiration,
+				"post":       post,
+			}).Info("Resumed saved channel for post")
+		} else {
+			stopSavedChannel(src, stored)
+			if !subscribePost(cfg, src, store, posts, post) {
+				continue
+			}
+		}
+
+		if stored.upToDate(cfg, post) {
+			posts.update(func() {
+				post.postPath, post.imagePath = stored.build.PostPath, stored.build.ImagePath
+				post.LastUpdated = stored.post.LastUpdated
+				post.lastBuild = stored.lastBuild()
+			})
+			logrus.WithField("post", post).Debug("Post unchanged since its last build, not rebuilding")
+			continue
+		}
+
+		build := newBuildResult(jobUpdate)
+		err = updatePost(cfg, src, posts, post, build.steps)
+		if err != nil {
+			logrus.WithError(err).WithField("post", post).Error("Failed to download drive file after subscribing")
+		}
+		finishBuild(store, posts, post, build, err)
 	}
 
-	if len(r.Files) == 0 {
-		return nil, fmt.Errorf("attic-posts folder not found")
+	// whatever is left was removed from the source while the program wasn't running
+	for folderID, stored := range saved {
+		stopSavedChannel(src, stored)
+		if err := store.removePost(folderID); err != nil {
+			logrus.WithError(err).WithField("folder", folderID).Error("Error removing saved post")
+		}
+		logrus.WithFields(logrus.Fields{
+			"author": stored.post.Author,
+			"date":   stored.post.Date,
+		}).Info("Saved post is no longer in the source, forgetting it")
 	}
 
-	logrus.Debug("Found attic-posts folder")
-	folder := r.Files[0]
+	// the posts are all built, so the site is published once for all of them
+	if err := publishSite(cfg, posts, nil, logrus.WithField("posts", posts.len())); err != nil {
+		logrus.WithError(err).Error("Error publishing site after subscribing")
+	}
+
+	return posts, nil
+}
 
-	posts := make(map[string]*Post)
-	authorFolders, err := driveService.Files.List().
-		Q(fmt.Sprintf("mimeType = 'application/vnd.google-apps.folder' and '%s' in parents and trashed = false", folder.Id)).
-		PageSize(15).Fields("nextPageToken, files(id, name)").Do()
+// postFolder is an author's date folder, which holds a single post
+type postFolder struct {
+	author string
+	date   SourceFile
+}
+
+// listPostFolders walks the posts folder and returns the date folder of every author
+func listPostFolders(src Source) ([]postFolder, error) {
+	authorFolders, err := src.ListAuthors()
 	if err != nil {
-		return nil, fmt.Errorf("Error getting list of author folders: %s", err.Error())
+		return nil, err
 	}
 
 	/*************************
 	* get all author folders *
 	*************************/
 
+	var folders []postFolder
 	logrus.Debug("Getting all author folders")
-	for i, author := range authorFolders.Files {
+	for i, author := range authorFolders {
 
 		if DEBUG && i > 0 {
 			logrus.Debug("First author processed, skipping rest")
-			return posts, nil
+			return folders, nil
+		}
+		if !validFolderName(author.Name) {
+			logrus.WithField("author", author.Name).Warn("Ignoring author folder with an invalid name")
+			continue
 		}
 
 		logrus.WithField("author", author.Name).Debug("Retrieving posts for author")
-		dateFolders, err := driveService.Files.List().
-			Q(fmt.Sprintf("mimeType = 'application/vnd.google-apps.folder' and '%s' in parents and trashed = false", author.Id)).
-			PageSize(10).Fields("nextPageToken, files(id, name)").Do()
+		dateFolders, err := src.ListPosts(author)
 		if err != nil {
-			return nil, fmt.Errorf("Error listing post folders for author '%s': %s", author.Name, err.Error())
+			return nil, err
 		}
 
 		/**********************************
 		* get all post folders for author *
 		**********************************/
 
-		for _, date := range dateFolders.Files {
-
-			logrus.WithField("date", date.Name).Debug("Retrieving post for author")
-			postFiles, err := driveService.Files.List().
-				Q(fmt.Sprintf("(mimeType = '%s' or mimeType = '%s') and '%s' in parents and trashed = false", docxMime, googleDocMime, date.Id)).
-				PageSize(1).Fields("files(id, name, mimeType)").Do()
-			if err != nil {
-				return nil, fmt.Errorf("Error retrieving post file: %s", err.Error())
-			}
-
-			if len(postFiles.Files) != 1 {
+		for _, date := range dateFolders {
+			if !validFolderName(date.Name) {
 				logrus.WithFields(logrus.Fields{
-					"actual":   len(postFiles.Files),
-					"expected": 1,
-				}).Error("Unexpected number of post files")
+					"author": author.Name,
+					"date":   date.Name,
+				}).Warn("Ignoring post folder with an invalid name")
 				continue
 			}
+			folders = append(folders, postFolder{author: author.Name, date: date})
+		}
+	}
 
-			logrus.WithField("date", date.Name).Debug("Retrieving image for post")
-			imageFiles, err := driveService.Files.List().
-				Q(fmt.Sprintf("mimeType = '%s' and '%s' in parents and trashed = false", jpegMime, date.Id)).
-				PageSize(1).Fields("files(id, name, mimeType)").Do()
-			if err != nil {
-				return nil, fmt.Errorf("Error retrieving image file: %s", err.Error())
-			}
+	return folders, nil
+}
 
-			if len(imageFiles.Files) != 1 {
-				logrus.WithFields(logrus.Fields{
-					"actual":   len(imageFiles.Files),
-					"expected": 1,
-				}).Error("Unexpected number of image files")
-				continue
-			}
+// subscribePost registers a post, watching its file first in the 'files' watch mode, and saves it. It returns false
+// if the post couldn't be watched or its folder is already tracked.
+func subscribePost(cfg *Config, src Source, store *stateStore, posts *PostRegistry, post *Post) bool {
+	if cfg.Drive.WatchMode == watchModeChanges {
+		if !posts.add(post.FolderID, post) {
+			return false
+		}
 
-			/************************************
-			* subscribe to updates on post file *
-			************************************/
-
-			postFile := postFiles.Files[0]
-			imageFile := imageFiles.Files[0]
-
-			channelID := generateHash(10)
-			expiration := time.Now().Add(time.Duration(1)*time.Minute).UnixNano() / 1000000
-			channel := &drive.Channel{
-				Kind:       "api#channel",
-				Id:         channelID,
-				Expiration: expiration,
-				ResourceId: postFile.Id,
-				Type:       "web_hook",
-				Address:    "https://theattic.us/api",
-				Payload:    true,
-			}
+		savePost(store, posts, post)
+		return true
+	}
 
-			returnedChannel, err := driveService.Files.Watch(postFile.Id, channel).Do()
-			if err != nil {
-				logrus.WithError(err).Error("Failed to subscribe to post file changes")
-			}
+	/************************************
+	* subscribe to updates on post file *
+	************************************/
 
-			post := &Post{
-				Author:        author.Name,
-				Date:          date.Name,
-				FileName:      postFile.Name,
-				FileExtension: postFile.FileExtension,
-				FileID:        postFile.Id,
-				MimeType:      postFile.MimeType,
-				LastUpdated:   time.Now().Add(time.Duration(-2) * time.Minute),
-				Channel:       returnedChannel,
-				image:         imageFile,
-				lock:          new(sync.Mutex),
-			}
+	returnedChannel, err := src.Watch(post.document())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to subscribe to post file changes")
+		return false
+	}
+	post.Channel = returnedChannel
+
+	logrus.WithFields(logrus.Fields{
+		"channel id": returnedChannel.ID,
+		"expiration": returnedChannel.Expiration,
+		"post":       post,
+	}).Info("Successfully subscribed to post")
+
+	posts.add(returnedChannel.ID, post)
+
+	savePost(store, posts, post)
+	return true
+}
 
+// savePost saves a newly subscribed post along with its channel, replacing any channel saved for its folder before.
+// The post is already registered, so it's saved from a snapshot.
+func savePost(store *stateStore, posts *PostRegistry, post *Post) {
+	snapshot := posts.snapshot(post)
+	if err := store.savePost(&snapshot); err != nil {
+		logrus.WithError(err).WithField("post", post).Error("Error saving post")
+	}
+	if err := store.saveChannel(post.FolderID, snapshot.Channel); err != nil {
+		logrus.WithError(err).WithField("post", post).Error("Error saving post channel")
+	}
+}
+
+// loadPost builds the Post stored in an author's date folder. It returns a nil Post if the folder doesn't (yet)
+// hold exactly one post document and at least one image.
+func loadPost(src Source, author string, date SourceFile) (*Post, error) {
+	logrus.WithField("date", date.Name).Debug("Retrieving post and image for author")
+	postFiles, imageFiles, err := src.ListPostFiles(date)
+	if err != nil {
+		return nil, err
+	}
+	postFiles, imageFiles = validSourceFiles(date, postFiles), validSourceFiles(date, imageFiles)
+
+	if len(postFiles) != 1 {
+		logrus.WithFields(logrus.Fields{
+			"actual":   len(postFiles),
+			"expected": 1,
+		}).Error("Unexpected number of post files")
+		return nil, nil
+	}
+
+	if len(imageFiles) == 0 {
+		logrus.WithField("date", date.Name).Error("Post has no image files")
+		return nil, nil
+	}
+
+	postFile := postFiles[0]
+	cover, gallery := selectCover(imageFiles)
+	return &Post{
+		Author:        author,
+		Date:          date.Name,
+		FolderID:      date.ID,
+		FileName:      postFile.Name,
+		FileExtension: postFile.FileExtension,
+		FileID:        postFile.ID,
+		MimeType:      postFile.MimeType,
+		checksum:      postFile.Checksum,
+		image:         cover,
+		gallery:       gallery,
+		lock:          new(sync.Mutex),
+	}, nil
+}
+
+// validSourceFiles drops files whose names can't be saved as a file of their own, logging each one
+func validSourceFiles(date SourceFile, files []SourceFile) []SourceFile {
+	var valid []SourceFile
+	for _, file := range files {
+		if !validSourceName(file.Name) {
 			logrus.WithFields(logrus.Fields{
-				"channel id": returnedChannel.Id,
-				"post":       post,
-			}).Info("Successfully subscribed to post")
+				"date": date.Name,
+				"name": file.Name,
+			}).Warn("Ignoring post file with an invalid name")
+			continue
+		}
+		valid = append(valid, file)
+	}
+	return valid
+}
 
-			posts[returnedChannel.Id] = post
+// validSourceName reports whether a source file's name leaves a file name once it's reduced to its last element by
+// sourceFilePath. Drive allows any name, including ones that would point outside the post's directory.
+func validSourceName(name string) bool {
+	base := filepath.Base(name)
+	return name != "" && base != "." && base != ".." && base != string(filepath.Separator)
+}
 
-			if err := updatePost(post); err != nil {
-				logrus.WithError(err).WithField("post", post).Error("Failed to download drive file after subscribing")
-			}
+// validFolderName reports whether an author or date folder's name can be used as a directory name as it is. Unlike
+// file names, folder names aren't reduced to their last element, so they must not hold a separator either.
+func validFolderName(name string) bool {
+	return validSourceName(name) && filepath.Base(name) == name
+}
+
+// sourceFilePath is where a source file with the given name is saved in dir
+func sourceFilePath(dir string, name string) string {
+	return filepath.Join(dir, filepath.Base(name))
+}
+
+// errIncompletePost is returned by reloadPost when the post's folder no longer holds a post
+var errIncompletePost = errors.New("post folder no longer holds exactly one document and at least one image")
+
+// reloadPost picks up a renamed document, and images that were added, removed, renamed or changed, including those
+// in names, which are known to have changed. The downloaded copies of images that changed or are gone are removed,
+// so new ones are downloaded and the thumbnails and gallery rebuilt. It doesn't wait for a running build of the post,
+// which is followed by another once the post is scheduled.
+func reloadPost(cfg *Config, src Source, posts *PostRegistry, post *Post, names []string) error {
+	reloaded, err := loadPost(src, post.Author, SourceFile{ID: post.FolderID, Name: post.Date})
+	if err != nil {
+		return err
+	}
+	if reloaded == nil {
+		return errIncompletePost
+	}
+
+	current := make(map[string]SourceFile)
+	for _, image := range append([]SourceFile{reloaded.image}, reloaded.gallery...) {
+		current[image.Name] = image
+	}
+	changed := make(map[string]bool)
+	for _, name := range names {
+		changed[name] = true
+	}
+	snapshot := posts.snapshot(post)
+	for _, image := range append([]SourceFile{snapshot.image}, snapshot.gallery...) {
+		if now, ok := current[image.Name]; ok && now == image && !changed[image.Name] {
+			continue
+		}
+		imagePath := sourceFilePath(cfg.postDownloadDir(post), image.Name)
+		if err := os.Remove(imagePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing outdated image: %s", err.Error())
 		}
 	}
 
-	return posts, nil
+	posts.update(func() {
+		post.FileName = reloaded.FileName
+		post.FileExtension = reloaded.FileExtension
+		post.FileID = reloaded.FileID
+		post.MimeType = reloaded.MimeType
+		post.checksum = reloaded.checksum
+		post.image = reloaded.image
+		post.gallery = reloaded.gallery
+	})
+	return nil
 }
 
-func startHTTPListener(posts map[string]*Post) {
+// startHTTPListener serves the API in the background, returning the server and, if the admin API has its own
+// listener, the admin server. Webhook notifications go through the gate, and requests to stop are sent on stop.
+func startHTTPListener(cfg *Config, src Source, store *stateStore, posts *PostRegistry, updates *updateScheduler, queue *buildQueue, site *sitePublisher, changes *changeWatcher, webhooks *webhookGate, stop chan<- struct{}) (*http.Server, *http.Server) {
 	router := mux.NewRouter()
 	logrus.Info("Starting http listener...")
 
-	router.HandleFunc("/api", HandlePostUpdate(posts))
-	router.HandleFunc("/api/stop", HandleStop(posts))
-	router.HandleFunc("/api/regenerate", HandleRegenerateHTML(posts))
-	router.HandleFunc("/api/regeneratethumbnails", HandleRegenerateThumbnails(posts))
+	router.HandleFunc("/api", webhooks.wrap(HandlePostUpdate(posts, updates, changes))).Methods(http.MethodPost)
 
-	if err := http.ListenAndServe(":9000", router); err != nil {
-		logrus.WithError(err).Fatal("error starting http listener")
+	/************
+	* admin API *
+	************/
+
+	admin := router
+	if cfg.Admin.ListenAddress != "" || cfg.Admin.Socket != "" {
+		admin = mux.NewRouter()
+	}
+	auth := newAdminAuth(cfg)
+	admin.HandleFunc("/api/stop", auth.wrap(HandleStop(stop))).Methods(http.MethodPost)
+	regens := newRegenerations(cfg, store, posts, queue, site)
+	admin.HandleFunc("/api/regenerate", auth.wrap(HandleRegenerateHTML(regens))).Methods(http.MethodPost)
+	admin.HandleFunc("/api/regeneratethumbnails", auth.wrap(HandleRegenerateThumbnails(regens))).Methods(http.MethodPost)
+	admin.HandleFunc("/api/regenerations/{id}", auth.wrap(HandleRegeneration(regens))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/regenerations/{id}/events", auth.wrap(HandleRegenerationEvents(regens))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/rescan", auth.wrap(HandleRescan(cfg, src, store, posts, updates))).Methods(http.MethodPost)
+	admin.HandleFunc("/api/queue", auth.wrap(HandleQueue(updates, queue, site))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/jobs/{id}", auth.wrap(HandleJob(queue))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/posts", auth.wrap(HandlePosts(posts))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/posts/{author}/{date}", auth.wrap(HandlePost(posts, site))).Methods(http.MethodGet)
+	admin.HandleFunc("/api/posts/{author}/{date}/rebuild", auth.wrap(HandleRebuildPost(cfg, src, store, posts, queue, site))).Methods(http.MethodPost)
+	admin.HandleFunc("/metrics", auth.wrap(promhttp.Handler().ServeHTTP)).Methods(http.MethodGet)
+
+	var adminServer *http.Server
+	if admin != router {
+		adminServer = startAdminListener(cfg, admin)
 	}
+
+	server := &http.Server{Addr: cfg.ListenAddress, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Fatal("error starting http listener")
+		}
+	}()
+	return server, adminServer
 }
 
-func HandlePostUpdate(posts map[string]*Post) func(w http.ResponseWriter, r *http.Request) {
+func HandlePostUpdate(posts *PostRegistry, updates *updateScheduler, changes *changeWatcher) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -234,69 +533,134 @@ func HandlePostUpdate(posts map[string]*Post) func(w http.ResponseWriter, r *htt
 			return
 		}
 
+		notificationsReceived.Inc()
+		id := r.Header.Get("X-Goog-Channel-ID")
+		token := r.Header.Get("X-Goog-Channel-Token")
+		resourceID := r.Header.Get("X-Goog-Resource-ID")
 		state := r.Header.Get("X-Goog-Resource-State")
+		if changes != nil && changes.owns(id) {
+			if !changes.verify(id, token, resourceID) {
+				rejectNotification(w, r, id)
+				return
+			}
+			if state == "change" {
+				changes.trigger()
+			} else {
+				skipNotification(skipState)
+			}
+			return
+		}
 		if state != "update" {
+			skipNotification(skipState)
 			return
 		}
 
+		header := r.Header.Clone()
+		header.Del("X-Goog-Channel-Token")
 		logrus.WithFields(logrus.Fields{
-			"header": r.Header,
+			"header": header,
 			"body":   body,
 		}).Debug("Have request")
 
-		var changes []string
+		var changed []string
 		for _, change := range strings.Split(r.Header.Get("X-Goog-Changed"), ",") {
 			if change == "content" || change == "properties" {
-				changes = append(changes, change)
+				changed = append(changed, change)
 			}
 		}
-		if len(changes) == 0 {
+		if len(changed) == 0 {
+			skipNotification(skipChangedFilter)
 			return
 		}
 
-		id := r.Header.Get("X-Goog-Channel-ID")
-		post, ok := posts[id]
+		post, ok, verified := posts.lookup(id, token, resourceID)
 		if !ok {
 			logrus.WithField("id", id).Error("Channel ID not found for post update")
+			skipNotification(skipUnknownChannel)
 			return
 		}
-
-		post.lock.Lock()
-		defer post.lock.Unlock()
-
-		if post.LastUpdated.After(time.Now().Add(-time.Duration(1) * time.Minute)) { // post was updated in the last minute
-			logrus.WithField("post", post).Debug("Post has been updated in the last minute, skipping")
+		if !verified {
+			rejectNotification(w, r, id)
 			return
 		}
 
-		post.LastUpdated = time.Now()
-
 		logrus.WithFields(logrus.Fields{
 			"state":   state,
-			"changes": changes,
+			"changes": changed,
 			"post":    post,
 		}).Debug("Received update notification for post")
 
-		if err := updatePost(post); err != nil {
-			logrus.WithField("post", post).Error("Failed to download drive file after update")
-		}
-
+		updates.schedule(post)
 		return
 	}
 }
 
-func updatePost(post *Post) error {
+// verifyNotification reports whether a notification sent to the channel with the given ID carries that channel's
+// token and resource ID. Notifications to the old channel of a post that is mid-renewal are checked against the old
+// channel. Callers hold the registry's lock.
+func (post *Post) verifyNotification(id string, token string, resourceID string) bool {
+	channel := post.Channel
+	if post.oldChannel != nil && post.oldChannel.ID == id {
+		channel = post.oldChannel
+	}
+	return channel != nil && channel.ID == id && channel.verify(token, resourceID)
+}
+
+// rejectNotification answers a notification that failed verification. Drive always sends the right token, so these
+// come from someone who only knows the channel ID.
+func rejectNotification(w http.ResponseWriter, r *http.Request, id string) {
+	logrus.WithFields(logrus.Fields{
+		"id":         id,
+		"remoteAddr": r.RemoteAddr,
+	}).Warn("Rejected notification with an invalid channel token or resource ID")
+	skipNotification(skipRejected)
+	w.WriteHeader(http.StatusForbidden)
+}
+
+// refreshPost downloads and rebuilds a post once the update scheduler decides its changes have settled. The site is
+// published separately.
+func refreshPost(cfg *Config, src Source, store *stateStore, posts *PostRegistry, post *Post) error {
+	post.lock.Lock()
+	defer post.lock.Unlock()
+
+	posts.update(func() { post.LastUpdated = time.Now() })
+
+	build := newBuildResult(jobUpdate)
+	err := updatePost(cfg, src, posts, post, build.steps)
+	if err != nil {
+		logrus.WithField("post", post).Error("Failed to download drive file after update")
+	}
+	finishBuild(store, posts, post, build, err)
+	return err
+}
+
+// finishBuild records how a build of the post went, for the status API and in the state file. Callers hold the
+// post's lock.
+func finishBuild(store *stateStore, posts *PostRegistry, post *Post, build *buildResult, err error) {
+	build.finish(err)
+	posts.update(func() { post.lastBuild = build })
+
+	snapshot := posts.snapshot(post)
+	if err := store.saveBuild(&snapshot, build); err != nil {
+		logrus.WithError(err).WithField("post", post).Error("Error saving build result")
+	}
+}
+
+// updatePost downloads the post and builds its html. Callers hold the post's lock.
+func updatePost(cfg *Config, src Source, posts *PostRegistry, post *Post, steps *buildSteps) error {
 	log := logrus.WithField("post", post)
-	log.Info("Downloading post from Google Drive")
+	log.Info("Downloading post")
 
-	var err error
-	post.postPath, post.imagePath, err = downloadPost(*post, log)
+	started := time.Now()
+	postPath, imagePath, err := downloadPost(cfg, src, posts.snapshot(post), steps, log)
+	steps.step("download", started, err)
+	posts.update(func() { post.postPath, post.imagePath = postPath, imagePath })
 	if err != nil {
-		log.WithError(err).Error("Error downloading post from google drive")
+		log.WithError(err).Error("Error downloading post")
 		return err
 	}
 
-	if err := generateHTML(*post, true, log); err != nil {
+	if err := generateHTML(cfg, posts.snapshot(post), true, steps, log); err != nil {
 		log.WithError(err).Error("Error updating html for post")
 		return err
 	}
@@ -304,26 +668,30 @@ func updatePost(post *Post) error {
 	return nil
 }
 
-// downloads input Post and returns the path to the download post, and the image path
-func downloadPost(post Post, log *logrus.Entry) (string, string, error) {
-	postDirectory := fmt.Sprintf("/home/grish/html/drive/%s/%s", post.Author, post.Date)
+// downloads input Post and its images, and returns the path to the download post and the cover image's path
+func downloadPost(cfg *Config, src Source, post Post, steps *buildSteps, log *logrus.Entry) (string, string, error) {
+	postDirectory := cfg.postDownloadDir(&post)
 
 	/******************************
 	* download and save post file *
 	******************************/
 
-	postPath := fmt.Sprintf("%s/%s", postDirectory, post.FileName)
+	if !validSourceName(post.FileName) {
+		return "", "", fmt.Errorf("Invalid post file name '%s'", post.FileName)
+	}
+	postPath := sourceFilePath(postDirectory, post.FileName)
 	if post.MimeType == googleDocMime && post.FileExtension == "" { // append file extension if missing
 		postPath = fmt.Sprintf("%s.docx", postPath)
 	}
 
 	{
 		// download post file
-		body, err := downloadDriveFile(post.FileID, post.MimeType)
+		body, err := src.FetchDocument(post.document())
 		if err != nil {
 			log.WithError(err).Error("Error downloading post")
 			return "", "", err
 		}
+		downloadBytes.WithLabelValues("document").Add(float64(len(body)))
 
 		log.WithField("postPath", postPath).Info("Saving post file locally")
 
@@ -347,41 +715,93 @@ func downloadPost(post Post, log *logrus.Entry) (string, string, error) {
 		}
 	}
 
-	/****************************
-	* ensure cover image exists *
-	*****************************/
+	/****************************************
+	* ensure cover and gallery images exist *
+	****************************************/
+
+	imagePath, err := downloadImage(cfg, src, postDirectory, post.image, steps, log)
+	if err != nil {
+		return "", "", err
+	}
+	for _, image := range post.gallery {
+		if _, err := downloadImage(cfg, src, postDirectory, image, steps, log); err != nil {
+			return "", "", err
+		}
+	}
+
+	return postPath, imagePath, nil
+}
 
-	// imageDownloaded := false
-	imagePath := fmt.Sprintf("%s/%s", postDirectory, post.image.Name)
+// downloadImage downloads one of the post's images into postDirectory, unless it's there already, and returns the
+// path of the downloaded image. HEIC and HEIF images are converted to jpeg, and the jpeg's path is returned instead.
+func downloadImage(cfg *Config, src Source, postDirectory string, image SourceFile, steps *buildSteps, log *logrus.Entry) (string, error) {
+	/*****************
+	* download image *
+	*****************/
+
+	if !validSourceName(image.Name) {
+		return "", fmt.Errorf("Invalid image file name '%s'", image.Name)
+	}
+	imageDownloaded := false
+	imagePath := sourceFilePath(postDirectory, image.Name)
 	{
 		exists, err := pathExists(imagePath)
 		if err != nil {
-			log.WithError(err).Error("Error checking whether post directory exists")
-			return "", "", err
+			log.WithError(err).Error("Error checking whether post image exists")
+			return "", err
 		}
 		if !exists {
 			log.WithField("imagePath", imagePath).Info("Downloading post image")
-			body, err := downloadDriveFile(post.image.Id, post.image.MimeType)
+			body, err := src.FetchImage(image)
 			if err != nil {
-				log.WithError(err).Error("Error downloading post")
-				return "", "", err
+				log.WithError(err).Error("Error downloading post image")
+				return "", err
 			}
+			downloadBytes.WithLabelValues("image").Add(float64(len(body)))
 
 			// save image file
 			if err := ioutil.WriteFile(imagePath, body, 0664); err != nil {
 				log.WithError(err).Error("Error saving image file")
-				return "", "", err
+				return "", err
 			}
 
-			// imageDownloaded = true
+			imageDownloaded = true
 		}
 	}
 
-	return postPath, imagePath, nil
+	/*****************************
+	* convert heic image to jpeg *
+	*****************************/
+
+	if isHEICMime(image.MimeType) {
+		jpegPath := downloadedImagePath(postDirectory, image)
+		exists, err := pathExists(jpegPath)
+		if err != nil {
+			log.WithError(err).Error("Error checking whether converted image exists")
+			return "", err
+		}
+		if imageDownloaded || !exists {
+			if err := convertHEIC(cfg, imagePath, jpegPath, steps, log); err != nil {
+				return "", err
+			}
+		}
+		imagePath = jpegPath
+	}
+
+	return imagePath, nil
 }
 
-// generate html for the input Post, given the paths where the post and its image are stored
-func generateHTML(post Post, createThumbnail bool, log *logrus.Entry) error {
+// downloadedImagePath is where downloadImage leaves an image downloaded into postDirectory
+func downloadedImagePath(postDirectory string, image SourceFile) string {
+	if isHEICMime(image.MimeType) {
+		return sourceFilePath(postDirectory, image.Name) + ".jpg"
+	}
+	return sourceFilePath(postDirectory, image.Name)
+}
+
+// generate html for the input Post, given the paths where the post and its image are stored. Only the post's own
+// html is built; the homepage and deploy are left to publishSite.
+func generateHTML(cfg *Config, post Post, createThumbnail bool, steps *buildSteps, log *logrus.Entry) error {
 	// ensure post and image paths are defined
 	if post.postPath == "" {
 		err := fmt.Errorf("Missing path to post to generate post's html")
@@ -396,7 +816,7 @@ func generateHTML(post Post, createThumbnail bool, log *logrus.Entry) error {
 	* make sure output html directory exists *
 	*****************************************/
 
-	htmlDirectory := fmt.Sprintf("/home/grish/html/html/posts/%s/%s", post.Author, post.Date)
+	htmlDirectory := cfg.postHTMLDir(&post)
 	{
 		exists, err := pathExists(htmlDirectory)
 		if err != nil {
@@ -411,28 +831,26 @@ func generateHTML(post Post, createThumbnail bool, log *logrus.Entry) error {
 		}
 	}
 
-	/****************************
-	* convert post file to html *
-	****************************/
+	/**********************
+	* copy gallery images *
+	**********************/
 
 	{
-		var args []string
-		args = append(args, "/home/grish/html/bin/convert_posts.zsh", "post")
-		args = append(args, post.postPath, htmlDirectory)
-
-		log.WithField("cmd", strings.Join(args, " ")).Info("Running script to update post html from docx")
-
-		cmd := exec.Command(args[0], args[1:]...)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			log.WithError(err).WithField("stderr", stderr.String()).Error("Failed to run script to update post html from docx")
+		started := time.Now()
+		err := copyGallery(cfg, post, htmlDirectory, log)
+		steps.step("gallery", started, err)
+		if err != nil {
+			log.WithError(err).Error("Error copying gallery images")
 			return err
 		}
+	}
+
+	/****************************
+	* convert post file to html *
+	****************************/
 
-		log.WithField("stdout", stdout.String()).Info("Successfully ran script to update post html from docx")
+	if err := convertPost(cfg, post, htmlDirectory, steps, log); err != nil {
+		return err
 	}
 
 	/**********************************************************
@@ -440,167 +858,106 @@ func generateHTML(post Post, createThumbnail bool, log *logrus.Entry) error {
 	**********************************************************/
 
 	if createThumbnail {
-		var args []string
-		title := strings.TrimSuffix(post.FileName, filepath.Ext(post.FileName))
-		args = append(args, "/home/grish/html/bin/make_thumbnail.zsh", title, post.Author, post.imagePath, htmlDirectory)
-
-		log.WithField("cmd", strings.Join(args, " ")).Info("Running script to create thumbnails from cover image")
-
-		cmd := exec.Command(args[0], args[1:]...)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			log.WithError(err).WithField("stderr", stderr.String()).Error("Failed to run script to update post html from docx")
-			return err
-		}
-
-		log.WithField("stdout", stdout.String()).Debug("Successfully ran script to update post html from docx")
-	}
-
-	/**************************
-	* regenerate the homepage *
-	**************************/
-
-	{
-		script := "/home/grish/html/bin/gen_homepage.zsh"
-
-		log.WithField("cmd", script).Info("Running script to generate homepage")
-
-		cmd := exec.Command(script)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			log.WithError(err).WithField("stderr", stderr.String()).Error("Failed to run script to generate homepage")
+		if err := makeThumbnails(cfg, post, htmlDirectory, steps, log); err != nil {
 			return err
 		}
-
-		log.WithField("stdout", stdout.String()).Debug("Successfully ran script to generate homepage")
-	}
-
-	/*****************************************
-	* rsync html directory with website root *
-	*****************************************/
-
-	{
-		var args []string
-		args = append(args, "/usr/local/bin/sudo", "/usr/local/bin/rsync", "-rl", "--delete", "/home/grish/html/html", "/usr/local/www")
-
-		log.WithField("cmd", strings.Join(args, " ")).Debug("Running command to sync html posts to attic root")
-
-		cmd := exec.Command(args[0], args[1:]...)
-		var stdout, stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			log.WithError(err).WithField("stderr", stderr.String()).Error("Failed to run command to sync html posts to attic root")
-			return err
-		}
-
-		log.WithField("stdout", stdout.String()).Debug("Successfully ran command to sync html posts to attic root")
 	}
 
 	return nil
 }
 
-func downloadDriveFile(fileID string, mimeType string) ([]byte, error) {
-	log := logrus.WithFields(logrus.Fields{
-		"fileID":   fileID,
-		"mimeType": mimeType,
-	})
-
-	var resp *http.Response
-	var err error
-	switch mimeType {
-	case docxMime, jpegMime: // download docx directly
-		resp, err = driveService.Files.Get(fileID).Download()
-	case googleDocMime: // export google doc files as docx
-		resp, err = driveService.Files.Export(fileID, docxMime).Download()
-	default:
-		return nil, fmt.Errorf("unsupported mime type: %s", mimeType)
-	}
-	if err != nil {
-		log.WithError(err).Error("Failed to fetch file from Google Drive")
-		return nil, err
-	}
-	defer resp.Body.Close()
+func HandleRegenerateHTML(regens *regenerations) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logrus.Info("Received request to regenerate HTML")
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.WithError(err).Error("Failed to read response body")
-		return nil, err
+		respondRegeneration(w, regens.start(jobRegenerate, false))
 	}
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err := fmt.Errorf("Got non-2XX status code from Google Drive")
-
-		var getError driveFileGetError
-		err2 := json.Unmarshal(body, &getError)
-		if err2 != nil {
-			log.WithError(err2).Error("Error unmarshalling json body into error")
-			return nil, err
-		}
+func HandleRegenerateThumbnails(regens *regenerations) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logrus.Info("Received request to regenerate HTML and thumbnails")
 
-		log.WithFields(logrus.Fields{
-			"status code": resp.StatusCode,
-			"json error":  err,
-		}).Error(err)
-		return nil, err
+		respondRegeneration(w, regens.start(jobRegenerateThumbnails, true))
 	}
+}
 
-	return body, nil
+// rebuildOptions are the options of a single post's rebuild
+type rebuildOptions struct {
+	Refetch    bool `json:"refetch"`    // download the document and images again first; implies Thumbnail
+	Thumbnail  bool `json:"thumbnail"`  // regenerate the post's thumbnails
+	SkipDeploy bool `json:"skipDeploy"` // don't publish the site afterwards
 }
 
-func HandleRegenerateHTML(posts map[string]*Post) func(w http.ResponseWriter, r *http.Request) {
+// HandleRebuildPost queues a rebuild of one post and responds with the job, which can be polled at /api/jobs/{id}.
+// The options are read from a JSON body; without one, the post's html is rebuilt from its downloaded files and the
+// site is published. Once shutdown has started, it responds 503 with the job, which has already failed.
+func HandleRebuildPost(cfg *Config, src Source, store *stateStore, posts *PostRegistry, queue *buildQueue, site *sitePublisher) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logrus.Info("Received request to regenerate HTML")
-
-		status := http.StatusOK
-		for _, post := range posts {
-			if err := generateHTML(*post, false, logrus.WithField("post", post)); err != nil {
-				logrus.WithError(err).Error("Error regenerating HTML for post")
-				status = http.StatusInternalServerError
-			}
+		vars := mux.Vars(r)
+		post := posts.find(vars["author"], vars["date"])
+		if post == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
 
-		w.WriteHeader(status)
-	}
-}
-
-func HandleRegenerateThumbnails(posts map[string]*Post) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		logrus.Info("Received request to regenerate HTML and thumbnails")
+		var options rebuildOptions
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil && err != io.EOF {
+			logrus.WithError(err).Warn("Invalid rebuild options")
+			http.Error(w, fmt.Sprintf("Invalid rebuild options: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
 
-		status := http.StatusOK
-		for _, post := range posts {
-			if err := generateHTML(*post, true, logrus.WithField("post", post)); err != nil {
-				logrus.WithError(err).Error("Error regenerating HTML and thumbnails for post")
-				status = http.StatusInternalServerError
+		job := queue.enqueueRebuild(post, options, func() error {
+			if err := rebuildPost(cfg, src, store, posts, post, options); err != nil {
+				return err
 			}
-		}
+			if !options.SkipDeploy {
+				site.request()
+			}
+			return nil
+		})
+		logrus.WithFields(logrus.Fields{
+			"job":     job.ID,
+			"post":    post,
+			"options": options,
+		}).Info("Received request to rebuild post")
 
+		snapshot, _ := queue.job(job.ID)
+		status := http.StatusAccepted
+		if snapshot.Status == jobFailed && snapshot.Started == nil { // failed without running, since the queue is closed
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/jobs/%s", job.ID))
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(status)
+		writeJSON(w, snapshot)
 	}
 }
 
-func HandleStop(posts map[string]*Post) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		logrus.Info("Received request to stop all listener channels")
+// rebuildPost rebuilds one post with the given options. The site is published separately.
+func rebuildPost(cfg *Config, src Source, store *stateStore, posts *PostRegistry, post *Post, options rebuildOptions) error {
+	post.lock.Lock()
+	defer post.lock.Unlock()
 
-		status := http.StatusOK
-		for _, post := range posts {
-			if err := driveService.Channels.Stop(post.Channel).Do(); err != nil {
-				logrus.WithError(err).Error("Error stopping channel")
-				status = http.StatusInternalServerError
+	log := logrus.WithField("post", post)
+	build := newBuildResult(jobRebuild)
+	var err error
+	if options.Refetch {
+		// images are only downloaded when they're missing. A HEIC image is converted again once the original is
+		// downloaded.
+		snapshot := posts.snapshot(post)
+		for _, image := range append([]SourceFile{snapshot.image}, snapshot.gallery...) {
+			imagePath := sourceFilePath(cfg.postDownloadDir(post), image.Name)
+			if err := os.Remove(imagePath); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).WithField("image", image.Name).Warn("Error removing downloaded image")
 			}
 		}
-
-		w.WriteHeader(status)
-		logrus.Info("Exiting...")
-		os.Exit(0)
+		posts.update(func() { post.LastUpdated = time.Now() })
+		err = updatePost(cfg, src, posts, post, build.steps)
+	} else {
+		err = generateHTML(cfg, posts.snapshot(post), options.Thumbnail, build.steps, log)
 	}
+	finishBuild(store, posts, post, build, err)
+	return err
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig builds posts from a memory source into temporary directories, with the native generators
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+
+	cfg := defaultConfig()
+	cfg.Drive.DownloadDir = tempDir(t)
+	cfg.HTML.OutputDir = tempDir(t)
+	cfg.defaultGenerators()
+	return cfg
+}
+
+// testDocument makes a docx holding one paragraph of body text
+func testDocument(t *testing.T, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]string{
+		"word/document.xml": `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` +
+			`<w:body><w:p><w:r><w:t>` + body + `</w:t></w:r></w:p></w:body></w:document>`,
+		"word/_rels/document.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"/>`,
+	}
+	for name, content := range files {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImage makes a png filled with c
+func testImage(t *testing.T, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 60, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 60; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// putTestPost adds a post with a document, a cover and one gallery image to src
+func putTestPost(t *testing.T, src *memorySource, author string, date string) {
+	t.Helper()
+
+	src.PutDocument(author, date, "My Post.docx", testDocument(t, "Hello from "+author))
+	src.PutImage(author, date, "cover.png", testImage(t, color.RGBA{R: 255, A: 255}))
+	src.PutImage(author, date, "beach.png", testImage(t, color.RGBA{B: 255, A: 255}))
+}
+
+/***********
+* loadPost *
+***********/
+
+func TestLoadPost(t *testing.T) {
+	src := newMemorySource()
+	src.PutDocument("alice", "2021-01-02", "My Post.docx", testDocument(t, "body"))
+	src.PutImage("alice", "2021-01-02", "b.jpg", testImage(t, color.White))
+	src.PutImage("alice", "2021-01-02", "cover.png", testImage(t, color.White))
+	src.PutImage("alice", "2021-01-02", "a.png", testImage(t, color.White))
+
+	post, err := loadPost(src, "alice", SourceFile{ID: "alice/2021-01-02", Name: "2021-01-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post == nil {
+		t.Fatal("loadPost returned no post")
+	}
+	if post.Author != "alice" || post.Date != "2021-01-02" || post.FolderID != "alice/2021-01-02" {
+		t.Errorf("post is %s in folder %s", post, post.FolderID)
+	}
+	if post.FileName != "My Post.docx" || post.FileID != "alice/2021-01-02/My Post.docx" || post.MimeType != docxMime {
+		t.Errorf("document is %+v", post.document())
+	}
+	if post.image.Name != "cover.png" || post.image.MimeType != pngMime {
+		t.Errorf("cover is %+v, want cover.png", post.image)
+	}
+	var gallery []string
+	for _, image := range post.gallery {
+		gallery = append(gallery, image.Name)
+	}
+	if !equalRows(gallery, []string{"a.png", "b.jpg"}) {
+		t.Errorf("gallery is %v, want [a.png b.jpg]", gallery)
+	}
+}
+
+func TestLoadIncompletePost(t *testing.T) {
+	src := newMemorySource()
+	src.PutImage("alice", "no-document", "cover.png", testImage(t, color.White))
+	src.PutDocument("alice", "no-image", "My Post.docx", testDocument(t, "body"))
+	src.PutDocument("alice", "two-documents", "One.docx", testDocument(t, "body"))
+	src.PutDocument("alice", "two-documents", "Two.docx", testDocument(t, "body"))
+	src.PutImage("alice", "two-documents", "cover.png", testImage(t, color.White))
+
+	for _, date := range []string{"no-document", "no-image", "two-documents"} {
+		post, err := loadPost(src, "alice", SourceFile{ID: "alice/" + date, Name: date})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if post != nil {
+			t.Errorf("%s: loaded %s, want no post", date, post)
+		}
+	}
+}
+
+/*******************
+* subscribeToPosts *
+*******************/
+
+// unreadableSource fails to list the files of one folder
+type unreadableSource struct {
+	*memorySource
+	folderID string
+}
+
+func (s unreadableSource) ListPostFiles(date SourceFile) ([]SourceFile, []SourceFile, error) {
+	if date.ID == s.folderID {
+		return nil, nil, fmt.Errorf("folder '%s' can't be read", date.ID)
+	}
+	return s.memorySource.ListPostFiles(date)
+}
+
+func TestSubscribeToPostsSkipsUnreadableFolders(t *testing.T) {
+	cfg := testConfig(t)
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+	putTestPost(t, src, "bob", "2021-02-03")
+	store, err := openStateStore(filepath.Join(tempDir(t), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	if _, err := subscribeToPosts(cfg, src, store); err != nil {
+		t.Fatal(err)
+	}
+
+	posts, err := subscribeToPosts(cfg, unreadableSource{src, "bob/2021-02-03"}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts.find("alice", "2021-01-02") == nil || posts.len() != 1 {
+		t.Errorf("%d posts subscribed to, want only alice's", posts.len())
+	}
+	saved, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := saved["bob/2021-02-03"]; !ok {
+		t.Error("saved post in the unreadable folder was forgotten")
+	}
+}
+
+/*************
+* updatePost *
+*************/
+
+func TestUpdatePost(t *testing.T) {
+	cfg := testConfig(t)
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+
+	post, err := loadPost(src, "alice", SourceFile{ID: "alice/2021-01-02", Name: "2021-01-02"})
+	if err != nil || post == nil {
+		t.Fatalf("loadPost returned %v, %v", post, err)
+	}
+	posts := newPostRegistry()
+	posts.add(post.FolderID, post)
+
+	update := func() {
+		post.lock.Lock()
+		defer post.lock.Unlock()
+
+		if err := updatePost(cfg, src, posts, post, new(buildSteps)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update()
+
+	downloaded := readTree(t, cfg.postDownloadDir(post))
+	for _, name := range []string{"My Post.docx", "cover.png", "beach.png"} {
+		if _, ok := downloaded[name]; !ok {
+			t.Errorf("%s wasn't downloaded, got %v", name, downloaded)
+		}
+	}
+
+	htmlDirectory := cfg.postHTMLDir(post)
+	built := readTree(t, htmlDirectory)
+	if page := built[cfg.Convert.OutputFile]; !strings.Contains(page, "Hello from alice") {
+		t.Errorf("page doesn't hold the post's body: %q", page)
+	}
+	for _, name := range []string{"thumbnail.jpg", "gallery/beach.png"} {
+		if _, ok := built[name]; !ok {
+			t.Errorf("%s wasn't built, got %v", name, built)
+		}
+	}
+	snapshot := posts.snapshot(post)
+	if snapshot.postPath != filepath.Join(cfg.postDownloadDir(post), "My Post.docx") {
+		t.Errorf("postPath is %s", snapshot.postPath)
+	}
+
+	// an edited document is downloaded again and rebuilt
+	src.PutDocument("alice", "2021-01-02", "My Post.docx", testDocument(t, "Edited by alice"))
+	if err := reloadPost(cfg, src, posts, post, nil); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	page, err := ioutil.ReadFile(filepath.Join(htmlDirectory, cfg.Convert.OutputFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "Edited by alice") {
+		t.Errorf("page wasn't rebuilt from the edited document: %q", page)
+	}
+
+	// a removed gallery image is dropped from the gallery
+	src.Remove("alice/2021-01-02/beach.png")
+	if err := reloadPost(cfg, src, posts, post, nil); err != nil {
+		t.Fatal(err)
+	}
+	update()
+	if _, err := os.Stat(filepath.Join(htmlDirectory, postGalleryDir)); !os.IsNotExist(err) {
+		t.Errorf("gallery is still there after its only image was removed: %v", err)
+	}
+}
+
+/******************
+* post file names *
+******************/
+
+func TestSourceFilePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+		path  string
+	}{
+		{"cover.jpg", true, "/dl/alice/2021-01-02/cover.jpg"},
+		{"../../cover.jpg", true, "/dl/alice/2021-01-02/cover.jpg"},
+		{"/etc/passwd", true, "/dl/alice/2021-01-02/passwd"},
+		{"", false, ""},
+		{".", false, ""},
+		{"..", false, ""},
+		{"photos/..", false, ""},
+		{"/", false, ""},
+	}
+	for _, test := range tests {
+		if valid := validSourceName(test.name); valid != test.valid {
+			t.Errorf("%q: valid = %v, want %v", test.name, valid, test.valid)
+		}
+		if !test.valid {
+			continue
+		}
+		if path := sourceFilePath("/dl/alice/2021-01-02", test.name); path != test.path {
+			t.Errorf("%q: path = %s, want %s", test.name, path, test.path)
+		}
+	}
+}
+
+func TestDownloadImageRejectsInvalidNames(t *testing.T) {
+	cfg := testConfig(t)
+	for _, name := range []string{"", ".", ".."} {
+		image := SourceFile{ID: "alice/2021-01-02/" + name, Name: name, MimeType: jpegMime}
+		if _, err := downloadImage(cfg, newMemorySource(), cfg.Drive.DownloadDir, image, nil, testLog()); err == nil {
+			t.Errorf("%q: downloaded an image with an invalid name", name)
+		}
+	}
+}
+
+// folderSource lists made-up author and date folders, which a memory source can't hold since its IDs are paths
+type folderSource struct {
+	*memorySource
+	authors []SourceFile
+	dates   map[string][]SourceFile // by author ID
+}
+
+func (s folderSource) ListAuthors() ([]SourceFile, error) {
+	return s.authors, nil
+}
+
+func (s folderSource) ListPosts(author SourceFile) ([]SourceFile, error) {
+	return s.dates[author.ID], nil
+}
+
+func TestListPostFoldersRejectsInvalidNames(t *testing.T) {
+	dates := []SourceFile{{ID: "date", Name: "2021-01-02"}, {ID: "dot", Name: "."}, {ID: "nested", Name: "2021/01"}}
+	src := folderSource{
+		memorySource: newMemorySource(),
+		authors: []SourceFile{
+			{ID: "alice", Name: "alice"},
+			{ID: "parent", Name: ".."},
+			{ID: "escaping", Name: "../bob"},
+			{ID: "empty", Name: ""},
+		},
+		dates: map[string][]SourceFile{"alice": dates, "parent": dates, "escaping": dates, "empty": dates},
+	}
+
+	folders, err := listPostFolders(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, folder := range folders {
+		found = append(found, folder.author+"/"+folder.date.Name)
+	}
+	if !equalRows(found, []string{"alice/2021-01-02"}) {
+		t.Errorf("found %v, want [alice/2021-01-02]", found)
+	}
+}
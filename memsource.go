@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memorySource is an in-memory Source, for exercising post handling without Google Drive. Folder and file IDs are
+// their paths: <author>, <author>/<date> and <author>/<date>/<file name>. The root folder's ID is "". Every put and
+// remove is recorded in its changes feed, and page tokens are indexes into it.
+type memorySource struct {
+	lock     sync.Mutex
+	files    map[string]*memoryFile // by ID
+	channels map[string]*Channel    // by channel ID
+	changes  []FeedChange
+}
+
+type memoryFile struct {
+	SourceFile
+	data []byte
+}
+
+func newMemorySource() *memorySource {
+	return &memorySource{
+		files:    make(map[string]*memoryFile),
+		channels: make(map[string]*Channel),
+	}
+}
+
+// PutDocument adds or replaces a post document, creating its author and date folders as needed
+func (s *memorySource) PutDocument(author string, date string, name string, data []byte) SourceFile {
+	return s.put(author, date, name, docxMime, data)
+}
+
+// PutImage adds or replaces an image, creating its author and date folders as needed. Its mime type is taken
+// from the name's extension, as in a local source, and is jpeg if that's unknown.
+func (s *memorySource) PutImage(author string, date string, name string, data []byte) SourceFile {
+	mimeType := localMimeType(strings.TrimPrefix(strings.ToLower(path.Ext(name)), "."))
+	if !isImageMime(mimeType) {
+		mimeType = jpegMime
+	}
+	return s.put(author, date, name, mimeType, data)
+}
+
+func (s *memorySource) put(author string, date string, name string, mimeType string, data []byte) SourceFile {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dateID := path.Join(author, date)
+	for _, folder := range []SourceFile{{ID: author, Name: author}, {ID: dateID, Name: date}} {
+		if _, ok := s.files[folder.ID]; !ok {
+			folder.MimeType = folderMime
+			s.files[folder.ID] = &memoryFile{SourceFile: folder}
+			s.changed(folder.ID)
+		}
+	}
+
+	file := &memoryFile{
+		SourceFile: SourceFile{
+			ID:            path.Join(dateID, name),
+			Name:          name,
+			MimeType:      mimeType,
+			FileExtension: strings.TrimPrefix(path.Ext(name), "."),
+			Checksum:      fmt.Sprintf("%x", md5.Sum(data)),
+		},
+		data: data,
+	}
+	s.files[file.ID] = file
+	s.changed(file.ID)
+	return file.SourceFile
+}
+
+// Remove deletes a file, or a folder and everything in it. As in Drive, only the removed file or folder itself shows
+// up in the changes feed.
+func (s *memorySource) Remove(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for fileID := range s.files {
+		if fileID == id || strings.HasPrefix(fileID, id+"/") {
+			delete(s.files, fileID)
+		}
+	}
+	s.changed(id)
+}
+
+// changed records a change to a file in the changes feed, as removed if it's no longer there
+func (s *memorySource) changed(id string) {
+	change := FeedChange{FileID: id, Removed: true}
+	if file, ok := s.files[id]; ok {
+		change = FeedChange{FileID: id, File: &FeedFile{SourceFile: file.SourceFile, Parents: []string{parentID(id)}}}
+	}
+	s.changes = append(s.changes, change)
+}
+
+// WatchingChannels returns the open channels on a file, ordered by ID, to deliver notifications to. Channels on the
+// changes feed are on "changes".
+func (s *memorySource) WatchingChannels(id string) []Channel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var channels []Channel
+	for _, channel := range s.channels {
+		if channel.ResourceID == id {
+			channels = append(channels, *channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].ID < channels[j].ID })
+	return channels
+}
+
+func (s *memorySource) ListAuthors() ([]SourceFile, error) {
+	return s.children(""), nil
+}
+
+func (s *memorySource) ListPosts(author SourceFile) ([]SourceFile, error) {
+	return s.children(author.ID), nil
+}
+
+func (s *memorySource) ListPostFiles(date SourceFile) ([]SourceFile, []SourceFile, error) {
+	var documents, images []SourceFile
+	for _, file := range s.children(date.ID) {
+		switch {
+		case file.MimeType == docxMime:
+			documents = append(documents, file)
+		case isImageMime(file.MimeType):
+			images = append(images, file)
+		}
+	}
+	return documents, images, nil
+}
+
+func (s *memorySource) FetchDocument(document SourceFile) ([]byte, error) {
+	return s.fetch(document.ID)
+}
+
+func (s *memorySource) FetchImage(image SourceFile) ([]byte, error) {
+	return s.fetch(image.ID)
+}
+
+func (s *memorySource) Watch(document SourceFile) (*Channel, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.files[document.ID]; !ok {
+		return nil, fmt.Errorf("Error watching file '%s': not found", document.ID)
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	channel := &Channel{
+		ID:         generateHash(10),
+		ResourceID: document.ID,
+		Token:      token,
+	}
+	s.channels[channel.ID] = channel
+	return channel, nil
+}
+
+func (s *memorySource) StopWatch(channel *Channel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.channels[channel.ID]; !ok {
+		return fmt.Errorf("channel '%s' not found", channel.ID)
+	}
+	delete(s.channels, channel.ID)
+	return nil
+}
+
+func (s *memorySource) RootFolderID() (string, error) {
+	return "", nil
+}
+
+func (s *memorySource) StartPageToken() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return strconv.Itoa(len(s.changes)), nil
+}
+
+// ListChanges returns every change from pageToken on in a single page
+func (s *memorySource) ListChanges(pageToken string) (*ChangePage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	from, err := strconv.Atoi(pageToken)
+	if err != nil || from < 0 || from > len(s.changes) {
+		return nil, fmt.Errorf("Error listing changes: invalid page token '%s'", pageToken)
+	}
+	return &ChangePage{
+		Changes:           append([]FeedChange(nil), s.changes[from:]...),
+		NewStartPageToken: strconv.Itoa(len(s.changes)),
+	}, nil
+}
+
+func (s *memorySource) GetFolder(id string) (*FeedFile, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return nil, fmt.Errorf("Error getting folder '%s': not found", id)
+	}
+	return &FeedFile{SourceFile: file.SourceFile, Parents: []string{parentID(id)}}, nil
+}
+
+func (s *memorySource) WatchChanges(pageToken string) (*Channel, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	channel := &Channel{
+		ID:         generateHash(10),
+		ResourceID: "changes",
+		Token:      token,
+	}
+	s.channels[channel.ID] = channel
+	return channel, nil
+}
+
+func (s *memorySource) fetch(id string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return nil, fmt.Errorf("file '%s' not found", id)
+	}
+	return append([]byte(nil), file.data...), nil
+}
+
+// children returns the files directly inside a folder, ordered by ID. The root folder's ID is "".
+func (s *memorySource) children(parent string) []SourceFile {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var children []SourceFile
+	for id, file := range s.files {
+		if parentID(id) == parent {
+			children = append(children, file.SourceFile)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+	return children
+}
+
+// parentID returns the ID of the folder a file is in
+func parentID(id string) string {
+	if dir := path.Dir(id); dir != "." {
+		return dir
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// reasons a notification doesn't lead to a build
+const (
+	skipState          = "state"           // a sync message, or a state that isn't a change
+	skipChangedFilter  = "changed_filter"  // X-Goog-Changed lists nothing that affects the post
+	skipDebounce       = "debounce"        // merged into a build that's already waiting
+	skipFeedCoalesced  = "feed_coalesced"  // the changes feed was already going to be read
+	skipUnknownChannel = "unknown_channel" // no post is watched by the channel
+	skipRejected       = "rejected"        // wrong channel token or resource ID
+)
+
+// stages of a build, each of which may run a script
+const (
+	stageConvert   = "convert"
+	stageThumbnail = "thumbnail"
+	stageHomepage  = "homepage"
+	stageDeploy    = "deploy"
+)
+
+/*****************************
+* metrics served at /metrics *
+*****************************/
+
+var (
+	notificationsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attic_notifications_received_total",
+		Help: "Webhook notifications received from Drive.",
+	})
+	notificationsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attic_notifications_skipped_total",
+		Help: "Notifications and changes that didn't start a build of their own, by reason.",
+	}, []string{"reason"})
+
+	driveCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attic_drive_api_calls_total",
+		Help: "Requests made to the Drive API, by call.",
+	}, []string{"call"})
+	driveErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attic_drive_api_errors_total",
+		Help: "Requests to the Drive API that failed or got an error status, by call.",
+	}, []string{"call"})
+	driveListsTruncated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attic_drive_list_truncated_total",
+		Help: "Files.List queries whose results didn't fit on the first page.",
+	})
+	driveListTruncatedFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "attic_drive_list_truncated_files_total",
+		Help: "Files past the first page of Files.List queries, which a single-page listing would have missed.",
+	})
+
+	downloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "attic_download_bytes_total",
+		Help: "Bytes of post documents and images fetched from the source.",
+	}, []string{"file"})
+
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "attic_build_stage_duration_seconds",
+		Help:    "How long each build stage took, including any script it fell back to.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"stage"})
+)
+
+func skipNotification(reason string) {
+	notificationsSkipped.WithLabelValues(reason).Inc()
+}
+
+// observeStage records how long a build stage took since started. It's deferred at the start of the stage.
+func observeStage(stage string, started time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(started).Seconds())
+}
+
+/******************
+* drive api calls *
+******************/
+
+// meteredTransport counts the requests made through it to the Drive API
+type meteredTransport struct {
+	base http.RoundTripper
+}
+
+func (t *meteredTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	call := driveCall(r)
+	driveCalls.WithLabelValues(call).Inc()
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil || resp.StatusCode >= 400 {
+		driveErrors.WithLabelValues(call).Inc()
+	}
+	return resp, err
+}
+
+// driveCall names the Drive API call a request makes, e.g. files.list or changes.watch
+func driveCall(r *http.Request) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/drive/v3/"), "/"), "/")
+	switch {
+	case parts[0] == "files" && len(parts) == 1:
+		return "files.list"
+	case parts[0] == "files" && len(parts) == 2:
+		return "files.get"
+	case parts[0] == "files" && len(parts) == 3: // export or watch
+		return "files." + parts[2]
+	case parts[0] == "changes" && len(parts) == 1:
+		return "changes.list"
+	case (parts[0] == "changes" || parts[0] == "channels") && len(parts) == 2:
+		return parts[0] + "." + parts[1]
+	}
+	return "other"
+}
+
+/***********
+* channels *
+***********/
+
+// channelCollector reports the open watch channels when metrics are scraped
+type channelCollector struct {
+	posts   *PostRegistry
+	changes *changeWatcher
+
+	active *prometheus.Desc
+	expiry *prometheus.Desc
+}
+
+func newChannelCollector(posts *PostRegistry, changes *changeWatcher) *channelCollector {
+	return &channelCollector{
+		posts:   posts,
+		changes: changes,
+		active:  prometheus.NewDesc("attic_active_channels", "Open watch channels, including the changes channel.", nil, nil),
+		expiry: prometheus.NewDesc("attic_channel_expiry_seconds",
+			"Seconds until the earliest channel expires; missing when no channel expires.", nil, nil),
+	}
+}
+
+func (c *channelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.expiry
+}
+
+func (c *channelCollector) Collect(ch chan<- prometheus.Metric) {
+	active := 0
+	var earliest time.Time
+	expires := func(expiration time.Time) {
+		active++
+		if !expiration.IsZero() && (earliest.IsZero() || expiration.Before(earliest)) {
+			earliest = expiration
+		}
+	}
+
+	for _, channel := range c.posts.channels() {
+		expires(channel.Expiration)
+	}
+	if c.changes != nil {
+		if expiration, ok := c.changes.expiration(); ok {
+			expires(expiration)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(active))
+	if !earliest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.expiry, prometheus.GaugeValue, time.Until(earliest).Seconds())
+	}
+}
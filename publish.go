@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sitePublisher runs the build steps that cover the whole site, regenerating the homepage and deploying, once for a
+// batch of post builds instead of once per post. Builds request a publish when they finish, and the requests are
+// flushed when the build queue runs dry, so a burst of builds is published together. Requests that arrive while a
+// publish is running are covered by the next one. A failed publish isn't retried; the site is published again with
+// the next request.
+type sitePublisher struct {
+	cfg   *Config
+	posts *PostRegistry
+
+	lock       sync.Mutex
+	published  *sync.Cond // signalled when a publish finishes
+	requested  int        // number of the latest request
+	started    int        // latest request covered by the running or last publish
+	finished   int        // latest request covered by the last finished publish
+	publishing bool
+	flushAgain bool         // flush was called during the running publish
+	runs       []publishRun // the latest finished publishes, oldest first
+	err        error        // of the last finished publish
+	lastRun    *time.Time
+	last       *buildResult // of the last finished publish, with its steps
+}
+
+// publishRun is a finished publish and the requests it covered
+type publishRun struct {
+	first int
+	last  int
+	err   error
+}
+
+// maxPublishRuns is how many finished publishes are kept for wait. A ticket is waited on right after its publish is
+// requested, so only the latest few are ever needed.
+const maxPublishRuns = 100
+
+// siteState is the state of the publisher, for the queue endpoint
+type siteState struct {
+	Waiting       bool       `json:"waiting"` // requests not covered by a publish yet
+	Publishing    bool       `json:"publishing"`
+	LastPublished *time.Time `json:"lastPublished,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+func newSitePublisher(cfg *Config, posts *PostRegistry) *sitePublisher {
+	p := &sitePublisher{
+		cfg:   cfg,
+		posts: posts,
+	}
+	p.published = sync.NewCond(&p.lock)
+	return p
+}
+
+// request marks the site as needing a publish and returns a ticket to wait on. It doesn't start the publish.
+func (p *sitePublisher) request() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.requested++
+	return p.requested
+}
+
+// flush starts a publish covering every request so far, unless there's nothing to publish. If a publish is already
+// running, another is started once it finishes.
+func (p *sitePublisher) flush() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.publishing {
+		p.flushAgain = true
+		return
+	}
+	if p.requested == p.started {
+		return
+	}
+	p.publishing = true
+	go p.run()
+}
+
+// drain publishes any requests that haven't been yet and waits for that publish, or for the context to be done
+func (p *sitePublisher) drain(ctx context.Context) error {
+	p.lock.Lock()
+	ticket := p.requested
+	p.lock.Unlock()
+
+	p.flush()
+	done := make(chan struct{})
+	go func() {
+		p.wait(ticket)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait blocks until a publish covering the ticket finishes, and returns that publish's error
+func (p *sitePublisher) wait(ticket int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.finished < ticket {
+		p.published.Wait()
+	}
+	for _, run := range p.runs {
+		if run.first <= ticket && ticket <= run.last {
+			return run.err
+		}
+	}
+	return fmt.Errorf("Publish of request %d finished too long ago to report its result", ticket)
+}
+
+func (p *sitePublisher) run() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for {
+		first := p.started + 1
+		covered := p.requested - p.started
+		p.started = p.requested
+		p.flushAgain = false
+		p.lock.Unlock()
+
+		log := logrus.WithField("requests", covered)
+		log.Info("Publishing site")
+		result := newBuildResult("publish")
+		err := publishSite(p.cfg, p.posts, result.steps, log)
+		if err != nil {
+			log.WithError(err).Error("Error publishing site")
+		}
+		result.finish(err)
+
+		p.lock.Lock()
+		p.finished = p.started
+		p.runs = append(p.runs, publishRun{first: first, last: p.finished, err: err})
+		if len(p.runs) > maxPublishRuns {
+			p.runs = p.runs[len(p.runs)-maxPublishRuns:]
+		}
+		p.err = err
+		p.lastRun = &result.Finished
+		p.last = result
+		p.published.Broadcast()
+
+		if !p.flushAgain || p.requested == p.started {
+			p.publishing = false
+			return
+		}
+	}
+}
+
+// state returns the publisher's state
+func (p *sitePublisher) state() siteState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	state := siteState{
+		Waiting:       p.requested > p.started,
+		Publishing:    p.publishing,
+		LastPublished: p.lastRun,
+	}
+	if p.err != nil {
+		state.LastError = p.err.Error()
+	}
+	return state
+}
+
+// lastPublish returns the result of the last finished publish, or nil if there hasn't been one
+func (p *sitePublisher) lastPublish() *buildResult {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.last
+}
+
+// publishSite regenerates the homepage from every post and deploys the html directory, recording each step in steps
+func publishSite(cfg *Config, posts *PostRegistry, steps *buildSteps, log *logrus.Entry) error {
+	/**************************
+	* regenerate the homepage *
+	**************************/
+
+	if err := generateHomepage(cfg, posts, steps, log); err != nil {
+		return err
+	}
+
+	/**********************************
+	* deploy html to the website root *
+	**********************************/
+
+	if err := deploySite(cfg, steps, log); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPublishErrorsAreKeptPerRun(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Deploy.Method = deployLocal
+	blocked := filepath.Join(tempDir(t), "blocked")
+	if err := ioutil.WriteFile(blocked, []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Deploy.Target = filepath.Join(blocked, "site")
+	site := newSitePublisher(cfg, newPostRegistry())
+
+	failed := site.request()
+	site.flush()
+	if err := site.wait(failed); err == nil {
+		t.Fatal("publish to an unwritable target succeeded")
+	}
+
+	// a later publish that succeeds doesn't change the result of the failed one, nor the other way round
+	cfg.Deploy.Target = tempDir(t)
+	published := site.request()
+	site.flush()
+	if err := site.wait(published); err != nil {
+		t.Errorf("second publish failed: %s", err)
+	}
+	if err := site.wait(failed); err == nil {
+		t.Error("failed publish reported as succeeded after a later one succeeded")
+	}
+}
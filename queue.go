@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// finishedJobsKept is how many finished jobs are remembered for lookups by ID
+const finishedJobsKept = 200
+
+// kinds of build job
+const (
+	jobUpdate               = "update"     // download and rebuild a changed post
+	jobRegenerate           = "regenerate" // rebuild a post's html from its downloaded files
+	jobRegenerateThumbnails = "regenerate-thumbnails"
+	jobRebuild              = "rebuild" // rebuild one post on request, with rebuildOptions
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// buildQueue runs post builds on a fixed pool of workers. Jobs run in the order they were queued, except that a
+// post's jobs never run at the same time: a job waits while an earlier job for the same post is running.
+type buildQueue struct {
+	lock     sync.Mutex
+	ready    *sync.Cond // signalled when a job is queued or finishes
+	queued   []*buildJob
+	running  map[*Post]*buildJob
+	jobs     map[string]*buildJob // every queued, running and recently finished job, by ID
+	finished []*buildJob          // oldest first
+	idle     func()               // called whenever the last queued or running job finishes
+	closed   bool                 // set by drain; no more jobs are taken
+	drained  chan struct{}        // closed once the queue is closed and empty
+}
+
+// buildJob is one unit of work for a post. Its exported fields are only changed with the queue's lock held.
+type buildJob struct {
+	ID       string     `json:"id"`
+	Author   string     `json:"author"`
+	Date     string     `json:"date"`
+	Kind     string     `json:"kind"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	Options *rebuildOptions `json:"options,omitempty"` // only for rebuilds
+
+	post *Post
+	run  func() error
+	done chan struct{} // closed when the job finishes
+}
+
+// newBuildQueue starts the given number of workers. idle is called each time the queue runs dry.
+func newBuildQueue(workers int, idle func()) *buildQueue {
+	q := &buildQueue{
+		idle:    idle,
+		running: make(map[*Post]*buildJob),
+		jobs:    make(map[string]*buildJob),
+	}
+	q.ready = sync.NewCond(&q.lock)
+
+	logrus.WithField("workers", workers).Info("Starting build workers")
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// enqueue queues a job for the post. If a job of the same kind is already waiting for the post, that job is
+// returned instead, since it hasn't started and will pick up the latest state of the post when it does. Once the
+// queue is draining, the returned job has already failed, and is kept for lookups by ID like any finished job.
+func (q *buildQueue) enqueue(post *Post, kind string, run func() error) *buildJob {
+	return q.add(post, kind, nil, run)
+}
+
+// enqueueRebuild queues a rebuild of the post. Like enqueue, it returns the rebuild already waiting for the post
+// instead, but only if that one was asked for with the same options.
+func (q *buildQueue) enqueueRebuild(post *Post, options rebuildOptions, run func() error) *buildJob {
+	return q.add(post, jobRebuild, &options, run)
+}
+
+func (q *buildQueue) add(post *Post, kind string, options *rebuildOptions, run func() error) *buildJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		now := time.Now()
+		job := &buildJob{
+			ID:       generateHash(12),
+			Author:   post.Author,
+			Date:     post.Date,
+			Kind:     kind,
+			Status:   jobFailed,
+			Error:    "shutting down",
+			Queued:   now,
+			Finished: &now,
+			Options:  options,
+			post:     post,
+			done:     make(chan struct{}),
+		}
+		close(job.done)
+		q.jobs[job.ID] = job
+		q.remember(job)
+		return job
+	}
+
+	for _, job := range q.queued {
+		if job.post == post && job.Kind == kind && (options == nil || *job.Options == *options) {
+			return job
+		}
+	}
+
+	job := &buildJob{
+		ID:      generateHash(12),
+		Author:  post.Author,
+		Date:    post.Date,
+		Kind:    kind,
+		Status:  jobQueued,
+		Queued:  time.Now(),
+		Options: options,
+		post:    post,
+		run:     run,
+		done:    make(chan struct{}),
+	}
+	q.queued = append(q.queued, job)
+	q.jobs[job.ID] = job
+	q.ready.Signal()
+
+	logrus.WithFields(logrus.Fields{
+		"job":  job.ID,
+		"kind": kind,
+		"post": post,
+	}).Debug("Queued build job")
+	return job
+}
+
+func (q *buildQueue) work() {
+	for {
+		job := q.next()
+
+		log := logrus.WithFields(logrus.Fields{
+			"job":  job.ID,
+			"kind": job.Kind,
+			"post": job.post,
+		})
+		log.Debug("Running build job")
+		err := job.run()
+
+		q.finish(job, err)
+		if err != nil {
+			log.WithError(err).Error("Build job failed")
+		} else {
+			log.Debug("Build job succeeded")
+		}
+	}
+}
+
+// next waits for the oldest queued job whose post isn't already being built, and marks it running
+func (q *buildQueue) next() *buildJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for i, job := range q.queued {
+			if _, busy := q.running[job.post]; busy {
+				continue
+			}
+			q.queued = append(q.queued[:i], q.queued[i+1:]...)
+			q.running[job.post] = job
+
+			now := time.Now()
+			job.Status = jobRunning
+			job.Started = &now
+			return job
+		}
+		q.ready.Wait()
+	}
+}
+
+func (q *buildQueue) finish(job *buildJob, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+	job.Finished = &now
+	job.Status = jobSucceeded
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = err.Error()
+	}
+	delete(q.running, job.post)
+	close(job.done)
+	q.remember(job)
+
+	// the post's next job, if any, can run now
+	q.ready.Broadcast()
+
+	if len(q.queued) == 0 && len(q.running) == 0 {
+		go q.idle()
+		if q.drained != nil {
+			close(q.drained)
+			q.drained = nil
+		}
+	}
+}
+
+// remember keeps a finished job for lookups by ID, forgetting the oldest once too many are kept. Callers hold the
+// lock.
+func (q *buildQueue) remember(job *buildJob) {
+	q.finished = append(q.finished, job)
+	if len(q.finished) > finishedJobsKept {
+		delete(q.jobs, q.finished[0].ID)
+		q.finished = q.finished[1:]
+	}
+}
+
+// drain stops the queue taking new jobs and waits for the queued and running ones to finish, or for the context to
+// be done
+func (q *buildQueue) drain(ctx context.Context) error {
+	q.lock.Lock()
+	q.closed = true
+	if len(q.queued) == 0 && len(q.running) == 0 {
+		q.lock.Unlock()
+		return nil
+	}
+	if q.drained == nil {
+		q.drained = make(chan struct{})
+	}
+	drained := q.drained
+	logrus.WithFields(logrus.Fields{
+		"queued":  len(q.queued),
+		"running": len(q.running),
+	}).Info("Waiting for build jobs to finish")
+	q.lock.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait blocks until the job finishes and returns its error, if it failed
+func (q *buildQueue) wait(job *buildJob) error {
+	<-job.done
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if job.Status == jobFailed {
+		return errors.New(job.Error)
+	}
+	return nil
+}
+
+// job returns a copy of the job with the given ID, safe to read without the lock
+func (q *buildQueue) job(id string) (buildJob, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return buildJob{}, false
+	}
+	return *job, true
+}
+
+// snapshot returns copies of the queued and running jobs, in the order they were queued
+func (q *buildQueue) snapshot() (queued []buildJob, running []buildJob) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queued = make([]buildJob, 0, len(q.queued))
+	for _, job := range q.queued {
+		queued = append(queued, *job)
+	}
+	running = make([]buildJob, 0, len(q.running))
+	for _, job := range q.running {
+		running = append(running, *job)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Queued.Before(running[j].Queued) })
+	return queued, running
+}
+
+func HandleJob(queue *buildQueue) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := queue.job(mux.Vars(r)["id"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			logrus.WithError(err).Error("Error writing build job")
+		}
+	}
+}
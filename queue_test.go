@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestQueueKeepsJobsAfterClosing(t *testing.T) {
+	q := newBuildQueue(1, func() {})
+	if err := q.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	post := &Post{Author: "alice", Date: "2021-01-02"}
+	ran := false
+	job := q.enqueue(post, jobUpdate, func() error {
+		ran = true
+		return nil
+	})
+	if err := q.wait(job); err == nil {
+		t.Error("job queued after closing didn't fail")
+	}
+	if ran {
+		t.Error("job queued after closing ran")
+	}
+	found, ok := q.job(job.ID)
+	if !ok {
+		t.Fatal("job queued after closing can't be looked up")
+	}
+	if found.Status != jobFailed || found.Started != nil {
+		t.Errorf("job is %+v, want failed without starting", found)
+	}
+}
+
+func TestRebuildAfterClosingIsUnavailable(t *testing.T) {
+	cfg := testConfig(t)
+	q := newBuildQueue(1, func() {})
+	if err := q.drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	posts := newPostRegistry()
+	post := &Post{Author: "alice", Date: "2021-01-02", FolderID: "alice/2021-01-02"}
+	posts.add(post.FolderID, post)
+
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/posts/alice/2021-01-02/rebuild", nil),
+		map[string]string{"author": "alice", "date": "2021-01-02"})
+	w := httptest.NewRecorder()
+	HandleRebuildPost(cfg, newMemorySource(), nil, posts, q, nil)(w, r)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	var job buildJob
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.job(job.ID); !ok || w.Header().Get("Location") != "/api/jobs/"+job.ID {
+		t.Errorf("job %q at %q can't be looked up", job.ID, w.Header().Get("Location"))
+	}
+}
+
+func TestGenerateHash(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := generateHash(12)
+		if len(id) != 12 {
+			t.Fatalf("%q isn't 12 characters", id)
+		}
+		if seen[id] {
+			t.Fatalf("%q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// finishedRegenerationsKept is how many finished regenerations are remembered for lookups by ID
+const finishedRegenerationsKept = 20
+
+// regeneration is a rebuild of every post from its downloaded files, run in the background. Its fields are only
+// changed with the lock of the regenerations it belongs to held.
+type regeneration struct {
+	ID           string       `json:"id"`
+	Kind         string       `json:"kind"`
+	Status       string       `json:"status"`
+	Total        int          `json:"total"`
+	Done         int          `json:"done"`
+	Failed       int          `json:"failed"`
+	Started      time.Time    `json:"started"`
+	Finished     *time.Time   `json:"finished,omitempty"`
+	PublishError string       `json:"publishError,omitempty"`
+	Results      []postResult `json:"results"` // in the order the posts finished
+}
+
+// postResult is how one post's rebuild went
+type postResult struct {
+	Author string `json:"author"`
+	Date   string `json:"date"`
+	Job    string `json:"job"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// regenerationProgress is sent on the event stream after each post finishes
+type regenerationProgress struct {
+	Done   int `json:"done"`
+	Total  int `json:"total"`
+	Failed int `json:"failed"`
+}
+
+// regenerations starts regenerations and keeps track of the running and recently finished ones
+type regenerations struct {
+	cfg   *Config
+	store *stateStore
+	posts *PostRegistry
+	queue *buildQueue
+	site  *sitePublisher
+
+	lock     sync.Mutex
+	byID     map[string]*regeneration
+	finished []string      // IDs, oldest first
+	changed  chan struct{} // closed and replaced whenever a regeneration changes
+}
+
+func newRegenerations(cfg *Config, store *stateStore, posts *PostRegistry, queue *buildQueue, site *sitePublisher) *regenerations {
+	return &regenerations{
+		cfg:     cfg,
+		store:   store,
+		posts:   posts,
+		queue:   queue,
+		site:    site,
+		byID:    make(map[string]*regeneration),
+		changed: make(chan struct{}),
+	}
+}
+
+// start begins regenerating every post in the background and returns a copy of the regeneration
+func (rs *regenerations) start(kind string, createThumbnail bool) regeneration {
+	list := rs.posts.list()
+	regen := &regeneration{
+		ID:      generateHash(12),
+		Kind:    kind,
+		Status:  jobRunning,
+		Total:   len(list),
+		Started: time.Now(),
+		Results: []postResult{},
+	}
+
+	rs.lock.Lock()
+	rs.byID[regen.ID] = regen
+	snapshot := regen.copy()
+	rs.lock.Unlock()
+
+	go rs.run(regen, list, createThumbnail)
+	return snapshot
+}
+
+// run queues a rebuild of each post, with no more than one per build worker queued at a time so post updates
+// aren't stuck behind the whole regeneration, then publishes the site once they've all finished
+func (rs *regenerations) run(regen *regeneration, list []*Post, createThumbnail bool) {
+	log := logrus.WithFields(logrus.Fields{
+		"regeneration": regen.ID,
+		"kind":         regen.Kind,
+		"posts":        regen.Total,
+	})
+	log.Info("Regenerating posts")
+
+	slots := make(chan struct{}, rs.cfg.Build.Workers)
+	var wg sync.WaitGroup
+	for _, post := range list {
+		post := post
+		slots <- struct{}{}
+		job := rs.queue.enqueue(post, regen.Kind, func() error {
+			post.lock.Lock()
+			defer post.lock.Unlock()
+
+			build := newBuildResult(regen.Kind)
+			err := generateHTML(rs.cfg, rs.posts.snapshot(post), createThumbnail, build.steps, logrus.WithField("post", post))
+			finishBuild(rs.store, rs.posts, post, build, err)
+			return err
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := rs.queue.wait(job)
+			<-slots
+
+			result := postResult{
+				Author: post.Author,
+				Date:   post.Date,
+				Job:    job.ID,
+				Status: jobSucceeded,
+			}
+			if err != nil {
+				log.WithError(err).WithField("job", job.ID).Error("Error regenerating post")
+				result.Status = jobFailed
+				result.Error = err.Error()
+			}
+			rs.update(regen, func() {
+				regen.Done++
+				if err != nil {
+					regen.Failed++
+				}
+				regen.Results = append(regen.Results, result)
+			})
+		}()
+	}
+	wg.Wait()
+
+	// publish now rather than when the queue runs dry, since other posts may still be building
+	ticket := rs.site.request()
+	rs.site.flush()
+	publishErr := rs.site.wait(ticket)
+
+	var failed int
+	rs.update(regen, func() {
+		failed = regen.Failed
+		now := time.Now()
+		regen.Finished = &now
+		regen.Status = jobSucceeded
+		if publishErr != nil {
+			regen.PublishError = publishErr.Error()
+		}
+		if regen.Failed > 0 || publishErr != nil {
+			regen.Status = jobFailed
+		}
+
+		rs.finished = append(rs.finished, regen.ID)
+		if len(rs.finished) > finishedRegenerationsKept {
+			delete(rs.byID, rs.finished[0])
+			rs.finished = rs.finished[1:]
+		}
+	})
+	log.WithField("failed", failed).Info("Finished regenerating posts")
+}
+
+// update changes a regeneration with the lock held and wakes everything waiting for a change
+func (rs *regenerations) update(regen *regeneration, change func()) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	change()
+	close(rs.changed)
+	rs.changed = make(chan struct{})
+}
+
+// get returns a copy of the regeneration with the given ID, and a channel that's closed when it next changes
+func (rs *regenerations) get(id string) (regeneration, <-chan struct{}, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	regen, ok := rs.byID[id]
+	if !ok {
+		return regeneration{}, nil, false
+	}
+	return regen.copy(), rs.changed, true
+}
+
+// copy returns a copy that's safe to read without the lock. Callers hold the lock.
+func (regen *regeneration) copy() regeneration {
+	snapshot := *regen
+	snapshot.Results = append([]postResult{}, regen.Results...)
+	return snapshot
+}
+
+// respondRegeneration answers a request that started a regeneration with where to follow it
+func respondRegeneration(w http.ResponseWriter, regen regeneration) {
+	w.Header().Set("Location", fmt.Sprintf("/api/regenerations/%s", regen.ID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, regen)
+}
+
+func HandleRegeneration(regens *regenerations) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		regen, _, ok := regens.get(mux.Vars(r)["id"])
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, regen)
+	}
+}
+
+/******************
+* progress stream *
+******************/
+
+// HandleRegenerationEvents streams a regeneration's progress as Server-Sent Events: a "post" event with each post's
+// result, a "progress" event once the results so far are sent, and a "done" event with the whole regeneration once it
+// finishes, after which the stream ends
+func HandleRegenerationEvents(regens *regenerations) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, _, ok := regens.get(id); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		sent, reported := 0, -1
+		for {
+			regen, changed, ok := regens.get(id)
+			if !ok { // forgotten while streaming
+				return
+			}
+
+			for ; sent < len(regen.Results); sent++ {
+				writeEvent(w, "post", regen.Results[sent])
+			}
+			if regen.Done != reported {
+				writeEvent(w, "progress", regenerationProgress{
+					Done:   regen.Done,
+					Total:  regen.Total,
+					Failed: regen.Failed,
+				})
+				reported = regen.Done
+			}
+			if regen.Finished != nil {
+				writeEvent(w, "done", regen)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logrus.WithError(err).WithField("event", event).Error("Error encoding event")
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
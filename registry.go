@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PostRegistry holds every post being followed, keyed by the ID notifications about the post arrive on: the ID of
+// its channel, or of its date folder when it has no channel of its own. While a channel is renewed the post is under
+// both the old and the new channel's ID.
+//
+// Its lock also guards the fields of each Post that change after the post is registered. Channel, oldChannel and the
+// files from the source are only changed with the registry's lock held, so the files can be refreshed while the post
+// builds, and a build reads them through a snapshot. What a build leaves behind, the downloaded paths, LastUpdated and
+// lastBuild, is changed with both the post's lock and the registry's lock held, so holding either is enough to read
+// it. Anything that holds neither reads the post through a snapshot. The post's lock is taken first.
+type PostRegistry struct {
+	lock  sync.RWMutex
+	posts map[string]*Post
+}
+
+func newPostRegistry() *PostRegistry {
+	return &PostRegistry{posts: make(map[string]*Post)}
+}
+
+// add registers the post under id, unless another post already has it
+func (r *PostRegistry) add(id string, post *Post) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.posts[id]; ok {
+		return false
+	}
+	r.posts[id] = post
+	return true
+}
+
+// get returns the post registered under id
+func (r *PostRegistry) get(id string) (*Post, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	post, ok := r.posts[id]
+	return post, ok
+}
+
+// lookup returns the post a notification to the channel with the given ID is about, and whether the notification
+// carries that channel's token and resource ID
+func (r *PostRegistry) lookup(id string, token string, resourceID string) (*Post, bool, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	post, ok := r.posts[id]
+	return post, ok, ok && post.verifyNotification(id, token, resourceID)
+}
+
+// list returns every post once, skipping the old ID of a channel that is being renewed
+func (r *PostRegistry) list() []*Post {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	list := make([]*Post, 0, len(r.posts))
+	for id, post := range r.posts {
+		if post.Channel == nil || id == post.Channel.ID {
+			list = append(list, post)
+		}
+	}
+	return list
+}
+
+// len returns the number of posts
+func (r *PostRegistry) len() int {
+	return len(r.list())
+}
+
+// find returns the post with the given author and date, or nil if there is none. A post's author, date and folder
+// never change, so they can be read without any lock.
+func (r *PostRegistry) find(author string, date string) *Post {
+	for _, post := range r.list() {
+		if post.Author == author && post.Date == date {
+			return post
+		}
+	}
+	return nil
+}
+
+// inFolder returns the post in the given date folder, or nil if there is none
+func (r *PostRegistry) inFolder(folderID string) *Post {
+	for _, post := range r.list() {
+		if post.FolderID == folderID {
+			return post
+		}
+	}
+	return nil
+}
+
+// withImage returns the post with the given cover or gallery image, or nil if there is none
+func (r *PostRegistry) withImage(fileID string) *Post {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, post := range r.posts {
+		if post.image.ID == fileID {
+			return post
+		}
+		for _, image := range post.gallery {
+			if image.ID == fileID {
+				return post
+			}
+		}
+	}
+	return nil
+}
+
+// snapshot returns a copy of the post that's safe to read without any lock
+func (r *PostRegistry) snapshot(post *Post) Post {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return *post
+}
+
+// snapshots returns a copy of every post, like list
+func (r *PostRegistry) snapshots() []Post {
+	list := r.list()
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	snapshots := make([]Post, 0, len(list))
+	for _, post := range list {
+		snapshots = append(snapshots, *post)
+	}
+	return snapshots
+}
+
+// update changes posts' fields with the registry's lock held
+func (r *PostRegistry) update(change func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	change()
+}
+
+// remove unregisters the post under every ID it has and takes its channel away from it, so it isn't renewed again.
+// It returns the channel, to be stopped, or nil if the post had none.
+func (r *PostRegistry) remove(post *Post) *Channel {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, registered := range r.posts {
+		if registered == post {
+			delete(r.posts, id)
+		}
+	}
+	channel := post.Channel
+	post.Channel = nil
+	return channel
+}
+
+// removeFile drops every post whose document or date folder has the given ID, and returns them
+func (r *PostRegistry) removeFile(fileID string) []*Post {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var removed []*Post
+	for id, post := range r.posts {
+		if post.FileID == fileID || post.FolderID == fileID {
+			delete(r.posts, id)
+			if post.Channel == nil || id == post.Channel.ID {
+				removed = append(removed, post)
+			}
+		}
+	}
+	return removed
+}
+
+/***********
+* channels *
+***********/
+
+// expiring returns the posts whose channels expire before the deadline
+func (r *PostRegistry) expiring(deadline time.Time) []*Post {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var expiring []*Post
+	for id, post := range r.posts {
+		if post.Channel == nil || id != post.Channel.ID { // not watched by file, or the old id of a channel mid-renewal
+			continue
+		}
+		if post.Channel.expiresBefore(deadline) {
+			expiring = append(expiring, post)
+		}
+	}
+	return expiring
+}
+
+// swapChannel makes newChannel the post's channel, keeping the old one registered until dropOldChannel, and returns
+// the old channel. If the post's channel was stopped in the meantime, nothing is swapped and nil is returned.
+func (r *PostRegistry) swapChannel(post *Post, newChannel *Channel) *Channel {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	oldChannel := post.Channel
+	if oldChannel == nil {
+		return nil
+	}
+	post.Channel = newChannel
+	post.oldChannel = oldChannel
+	r.posts[newChannel.ID] = post
+	return oldChannel
+}
+
+// dropOldChannel unregisters the channel a post's channel replaced
+func (r *PostRegistry) dropOldChannel(post *Post, oldChannel *Channel) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.posts, oldChannel.ID)
+	post.oldChannel = nil
+}
+
+// detachChannels takes every post's channel away from it, so none is renewed again, and returns them to be stopped
+func (r *PostRegistry) detachChannels() map[*Post]*Channel {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	detached := make(map[*Post]*Channel)
+	for id, post := range r.posts {
+		if post.Channel == nil || id != post.Channel.ID {
+			continue
+		}
+		detached[post] = post.Channel
+		post.Channel = nil
+	}
+	return detached
+}
+
+// channels returns the channel of every post that has one
+func (r *PostRegistry) channels() []*Channel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var channels []*Channel
+	for id, post := range r.posts {
+		if post.Channel != nil && id == post.Channel.ID {
+			channels = append(channels, post.Channel)
+		}
+	}
+	return channels
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TestConcurrentUpdatesAndRegenerations sends update notifications and regeneration requests for the same posts at
+// the same time, while their documents change, and checks every post ends up built from its latest document. Run it
+// with -race.
+func TestConcurrentUpdatesAndRegenerations(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Build.Workers = 3
+	cfg.Debounce.QuietPeriod = time.Millisecond
+	cfg.Debounce.MaxWait = 5 * time.Millisecond
+	cfg.Deploy.Method = deployLocal
+	cfg.Deploy.Target = tempDir(t)
+
+	src := newMemorySource()
+	authors := []string{"alice", "bob", "carol"}
+	for _, author := range authors {
+		putTestPost(t, src, author, "2021-01-02")
+	}
+	store, err := openStateStore(filepath.Join(tempDir(t), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	/*********************************
+	* wire up the daemon, as in main *
+	*********************************/
+
+	posts, err := subscribeToPosts(cfg, src, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts.len() != len(authors) {
+		t.Fatalf("%d posts subscribed to, want %d", posts.len(), len(authors))
+	}
+	site := newSitePublisher(cfg, posts)
+	queue := newBuildQueue(cfg.Build.Workers, site.flush)
+	updates := newUpdateScheduler(cfg, func(post *Post) {
+		queue.enqueue(post, jobUpdate, func() error {
+			if err := refreshPost(cfg, src, store, posts, post); err != nil {
+				return err
+			}
+			site.request()
+			return nil
+		})
+	})
+	regens := newRegenerations(cfg, store, posts, queue, site)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api", HandlePostUpdate(posts, updates, nil)).Methods(http.MethodPost)
+	router.HandleFunc("/api/regenerate", HandleRegenerateHTML(regens)).Methods(http.MethodPost)
+	router.HandleFunc("/api/posts", HandlePosts(posts)).Methods(http.MethodGet)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	/***************************************
+	* notify and regenerate simultaneously *
+	***************************************/
+
+	const rounds = 10
+	var regenerationIDs []string
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, author := range authors {
+		author := author
+		post := posts.find(author, "2021-01-02")
+		channel := posts.snapshot(post).Channel
+		var documents [][]byte
+		for i := 0; i < rounds; i++ {
+			documents = append(documents, testDocument(t, fmt.Sprintf("%s edit %d", author, i)))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				src.PutDocument(author, "2021-01-02", "My Post.docx", documents[i])
+				req, _ := http.NewRequest(http.MethodPost, server.URL+"/api", nil)
+				req.Header.Set("X-Goog-Channel-ID", channel.ID)
+				req.Header.Set("X-Goog-Channel-Token", channel.Token)
+				req.Header.Set("X-Goog-Resource-ID", channel.ResourceID)
+				req.Header.Set("X-Goog-Resource-State", "update")
+				req.Header.Set("X-Goog-Changed", "content")
+				if status := send(t, req); status != http.StatusOK {
+					t.Errorf("notification for %s answered %d", author, status)
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			resp, err := http.Post(server.URL+"/api/regenerate", "", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var regen regeneration
+			err = json.NewDecoder(resp.Body).Decode(&regen)
+			resp.Body.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			regenerationIDs = append(regenerationIDs, regen.ID)
+			lock.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/posts", nil)
+			if status := send(t, req); status != http.StatusOK {
+				t.Errorf("listing posts answered %d", status)
+			}
+		}
+	}()
+	wg.Wait()
+
+	/******************************
+	* wait for everything to land *
+	******************************/
+
+	deadline := time.Now().Add(30 * time.Second)
+	for _, id := range regenerationIDs {
+		for {
+			regen, _, ok := regens.get(id)
+			if ok && regen.Finished != nil {
+				if regen.Failed > 0 || regen.PublishError != "" {
+					t.Errorf("regeneration %s: %d failed, publish error %q", id, regen.Failed, regen.PublishError)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("regeneration %s didn't finish", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for len(updates.pendingPosts()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("post updates didn't settle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	updates.stop()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := queue.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := site.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, author := range authors {
+		post := posts.find(author, "2021-01-02")
+		page, err := ioutil.ReadFile(filepath.Join(cfg.postHTMLDir(post), cfg.Convert.OutputFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%s edit %d", author, rounds-1); !strings.Contains(string(page), want) {
+			t.Errorf("%s's page doesn't hold %q: %q", author, want, page)
+		}
+		if build := posts.snapshot(post).lastBuild; build == nil || build.Status != jobSucceeded {
+			t.Errorf("%s's last build is %+v", author, build)
+		}
+	}
+}
+
+// send makes a request and returns its status, failing the test if it can't be made
+func send(t *testing.T, req *http.Request) int {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rescanLock keeps a periodic and an on-demand rescan from subscribing the same new post twice
+var rescanLock sync.Mutex
+
+// rescansStopped is set once shutdown starts stopping channels, so no rescan opens new ones. Guarded by rescanLock.
+var rescansStopped bool
+
+// rescanResult reports the posts a rescan found, and those it no longer found
+type rescanResult struct {
+	Added   []rescanPost `json:"added"`
+	Removed []rescanPost `json:"removed"`
+}
+
+type rescanPost struct {
+	Author   string `json:"author"`
+	Date     string `json:"date"`
+	FileName string `json:"fileName"`
+}
+
+// rescanPosts walks the source's folder tree and subscribes to and builds every post that isn't tracked yet. Posts
+// whose folders are gone, moved out of the tree or trashed along with their author's folder, are no longer tracked.
+func rescanPosts(cfg *Config, src Source, store *stateStore, posts *PostRegistry, updates *updateScheduler) (*rescanResult, error) {
+	rescanLock.Lock()
+	defer rescanLock.Unlock()
+
+	if rescansStopped {
+		return nil, fmt.Errorf("Not rescanning, shutting down")
+	}
+
+	folders, err := listPostFolders(src)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, post := range posts.list() {
+		known[post.FolderID] = true
+	}
+	listed := make(map[string]bool)
+	for _, folder := range folders {
+		listed[folder.date.ID] = true
+	}
+
+	result := &rescanResult{Added: []rescanPost{}, Removed: []rescanPost{}}
+	for _, post := range posts.list() {
+		if listed[post.FolderID] {
+			continue
+		}
+		result.Removed = append(result.Removed, rescanPost{
+			Author:   post.Author,
+			Date:     post.Date,
+			FileName: posts.snapshot(post).FileName,
+		})
+		forgetPost(src, store, posts, post)
+	}
+
+	for _, folder := range folders {
+		if known[folder.date.ID] {
+			continue
+		}
+
+		post, err := loadPost(src, folder.author, folder.date)
+		if err != nil { // e.g. a folder that's still being created; the next rescan tries it again
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"author": folder.author,
+				"date":   folder.date.Name,
+			}).Error("Error loading post folder during rescan")
+			continue
+		}
+		if post == nil {
+			continue
+		}
+		added := rescanPost{
+			Author:   post.Author,
+			Date:     post.Date,
+			FileName: post.FileName,
+		}
+		if !subscribePost(cfg, src, store, posts, post) {
+			continue
+		}
+
+		logrus.WithField("post", post).Info("Rescan found new post")
+		result.Added = append(result.Added, added)
+
+		updates.schedule(post)
+	}
+
+	return result, nil
+}
+
+// forgetPost stops following a post that's no longer in the source. Its html is left in place.
+func forgetPost(src Source, store *stateStore, posts *PostRegistry, post *Post) {
+	if channel := posts.remove(post); channel != nil {
+		if err := src.StopWatch(channel); err != nil {
+			logrus.WithError(err).WithField("post", post).Warn("Error stopping channel of removed post")
+		}
+	}
+	if err := store.removePost(post.FolderID); err != nil {
+		logrus.WithError(err).WithField("post", post).Error("Error removing saved post")
+	}
+	logrus.WithField("post", post).Warn("Post is no longer in the source, no longer tracking it")
+}
+
+// stopRescans waits for a running rescan and keeps any more from starting
+func stopRescans() {
+	rescanLock.Lock()
+	defer rescanLock.Unlock()
+
+	rescansStopped = true
+}
+
+// runPeriodicRescan rescans the source's folder tree every configured interval until the program exits
+func runPeriodicRescan(cfg *Config, src Source, store *stateStore, posts *PostRegistry, updates *updateScheduler) {
+	logrus.WithField("interval", cfg.Drive.RescanInterval).Info("Starting periodic rescan")
+	ticker := time.NewTicker(cfg.Drive.RescanInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := rescanPosts(cfg, src, store, posts, updates)
+		if err != nil {
+			logrus.WithError(err).Error("Error rescanning posts")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"added":   len(result.Added),
+			"removed": len(result.Removed),
+		}).Info("Finished periodic rescan")
+	}
+}
+
+func HandleRescan(cfg *Config, src Source, store *stateStore, posts *PostRegistry, updates *updateScheduler) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logrus.Info("Received request to rescan posts")
+
+		result, err := rescanPosts(cfg, src, store, posts, updates)
+		if err != nil {
+			logrus.WithError(err).Error("Error rescanning posts")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logrus.WithError(err).Error("Error writing rescan result")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image/color"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRescanPosts(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debounce.QuietPeriod = time.Millisecond
+	src := newMemorySource()
+	putTestPost(t, src, "alice", "2021-01-02")
+	putTestPost(t, src, "bob", "2021-02-03")
+	src.PutDocument("bob", "2021-03-04", "Draft.docx", testDocument(t, "no cover yet"))
+
+	scheduled := make(chan *Post, 10)
+	updates := newUpdateScheduler(cfg, func(post *Post) { scheduled <- post })
+	defer updates.stop()
+	posts := newPostRegistry()
+
+	rescan := func() *rescanResult {
+		t.Helper()
+
+		result, err := rescanPosts(cfg, src, nil, posts, updates)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	names := func(found []rescanPost) []string {
+		var names []string
+		for _, post := range found {
+			names = append(names, post.Author+"/"+post.Date)
+		}
+		sort.Strings(names)
+		return names
+	}
+	waitForBuilds := func(want []string) {
+		t.Helper()
+
+		var built []string
+		for range want {
+			select {
+			case post := <-scheduled:
+				built = append(built, post.String())
+			case <-time.After(5 * time.Second):
+				t.Fatalf("built %v, want %v", built, want)
+			}
+		}
+		sort.Strings(built)
+		if !equalRows(built, want) {
+			t.Errorf("built %v, want %v", built, want)
+		}
+	}
+
+	// every complete post is subscribed to and built
+	result := rescan()
+	if added := names(result.Added); !equalRows(added, []string{"alice/2021-01-02", "bob/2021-02-03"}) {
+		t.Errorf("added %v", added)
+	}
+	if len(result.Removed) != 0 {
+		t.Errorf("removed %v", names(result.Removed))
+	}
+	waitForBuilds([]string{"alice/2021-01-02", "bob/2021-02-03"})
+	if channels := src.WatchingChannels("alice/2021-01-02/My Post.docx"); len(channels) != 1 {
+		t.Errorf("alice's post has %d channels, want 1", len(channels))
+	}
+
+	// known posts are left alone, and a post is picked up once its folder is complete
+	src.PutImage("bob", "2021-03-04", "cover.png", testImage(t, color.White))
+	result = rescan()
+	if added := names(result.Added); !equalRows(added, []string{"bob/2021-03-04"}) {
+		t.Errorf("added %v", added)
+	}
+	waitForBuilds([]string{"bob/2021-03-04"})
+
+	// a post whose folder is gone is no longer tracked
+	src.Remove("alice")
+	result = rescan()
+	if len(result.Added) != 0 {
+		t.Errorf("added %v", names(result.Added))
+	}
+	if removed := names(result.Removed); !equalRows(removed, []string{"alice/2021-01-02"}) {
+		t.Errorf("removed %v", removed)
+	}
+	if post := posts.find("alice", "2021-01-02"); post != nil {
+		t.Errorf("%s is still tracked", post)
+	}
+	if posts.len() != 2 {
+		t.Errorf("%d posts tracked, want 2", posts.len())
+	}
+	if channels := src.WatchingChannels("alice/2021-01-02/My Post.docx"); len(channels) != 0 {
+		t.Errorf("removed post still has %d channels", len(channels))
+	}
+}
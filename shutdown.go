@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// webhookGate turns webhook notifications away once shutdown starts. They're answered with 503 so nothing is lost
+// that a retry could deliver, though after shutdown the channels are stopped.
+type webhookGate struct {
+	closed int32
+}
+
+func (g *webhookGate) close() {
+	atomic.StoreInt32(&g.closed, 1)
+}
+
+func (g *webhookGate) wrap(handler func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&g.closed) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// shutdown is everything that has to be stopped, in order, before the program exits
+type shutdown struct {
+	cfg      *Config
+	server   *http.Server
+	admin    *http.Server // nil unless the admin API has its own listener
+	webhooks *webhookGate
+	src      Source
+	local    *localSource // nil unless the source is local
+	store    *stateStore
+	posts    *PostRegistry
+	updates  *updateScheduler
+	queue    *buildQueue
+	site     *sitePublisher
+	channels *channelManager // nil unless each post has its own channel
+	changes  *changeWatcher
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM arrives or a stop is requested over http. A second signal kills
+// the program without waiting for the shutdown.
+func waitForShutdown(stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		logrus.WithField("signal", sig.String()).Info("Received signal, shutting down")
+	case <-stop:
+		logrus.Info("Received request to stop, shutting down")
+	}
+}
+
+// run stops taking notifications, waits for running builds and the deploy after them, stops every channel, shuts
+// down the http servers and finally closes the state file. Builds that haven't finished within the shutdown timeout
+// are abandoned; their posts are rebuilt on the next start since their saved build results are out of date.
+func (s *shutdown) run() {
+	/*************************
+	* stop taking new builds *
+	*************************/
+
+	s.webhooks.close()
+	if dropped := s.updates.stop(); dropped > 0 {
+		logrus.WithField("posts", dropped).Warn("Dropped post updates waiting for changes to settle")
+	}
+	if s.local != nil {
+		if err := s.local.close(); err != nil {
+			logrus.WithError(err).Error("Error closing local posts directory watcher")
+		}
+	}
+
+	/**************************************
+	* wait for running builds and deploys *
+	**************************************/
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Shutdown.Timeout)
+	defer cancel()
+
+	if err := s.queue.drain(ctx); err != nil {
+		logrus.WithError(err).Warn("Timed out waiting for builds to finish")
+	} else if err := s.site.drain(ctx); err != nil {
+		logrus.WithError(err).Warn("Timed out waiting for the site to publish")
+	}
+
+	/****************
+	* stop channels *
+	****************/
+
+	if s.channels != nil {
+		s.channels.close()
+	}
+	if s.changes != nil {
+		s.changes.close()
+	}
+	stopRescans()
+	if err := stopChannels(s.src, s.store, s.posts, s.changes); err != nil {
+		logrus.WithError(err).Error("Error stopping channels")
+	}
+
+	/*************************************
+	* close the listeners and state file *
+	*************************************/
+
+	// in-flight requests finish first, so no handler uses the state file after it's closed
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), s.cfg.Shutdown.Timeout)
+	defer serverCancel()
+	if err := s.server.Shutdown(serverCtx); err != nil {
+		logrus.WithError(err).Error("Error shutting down http listener")
+	}
+	if s.admin != nil {
+		if err := s.admin.Shutdown(serverCtx); err != nil {
+			logrus.WithError(err).Error("Error shutting down admin listener")
+		}
+	}
+
+	if err := s.store.close(); err != nil {
+		logrus.WithError(err).Error("Error closing state file")
+	}
+
+	logrus.Info("Exiting...")
+}
+
+// stopChannels stops the channel of every post and the changes channel, and removes them from the state file since
+// stopped channels can't be resumed
+func stopChannels(src Source, store *stateStore, posts *PostRegistry, changes *changeWatcher) error {
+	var lastErr error
+
+	// channels taken from their posts aren't renewed again, and a renewal already under way stops its new channel
+	for post, channel := range posts.detachChannels() {
+		if err := src.StopWatch(channel); err != nil {
+			logrus.WithError(err).WithField("post", post).Error("Error stopping channel")
+			lastErr = err
+		}
+		if err := store.saveChannel(post.FolderID, nil); err != nil {
+			logrus.WithError(err).WithField("post", post).Error("Error removing saved channel")
+		}
+	}
+
+	if changes != nil {
+		if err := changes.stop(); err != nil {
+			logrus.WithError(err).Error("Error stopping changes channel")
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// HandleStop starts a graceful shutdown, the same as SIGTERM
+func HandleStop(stop chan<- struct{}) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case stop <- struct{}{}:
+		default: // already stopping
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
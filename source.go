@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/subtle"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source is where posts are written. Posts are laid out as <author>/<date>/, each date folder holding a single post
+// document and its images: the cover image, and any others, which are published as the post's gallery.
+type Source interface {
+	// ListAuthors returns the folder of every author
+	ListAuthors() ([]SourceFile, error)
+	// ListPosts returns an author's date folders
+	ListPosts(author SourceFile) ([]SourceFile, error)
+	// ListPostFiles returns the post documents and images in a date folder
+	ListPostFiles(date SourceFile) (documents []SourceFile, images []SourceFile, err error)
+	// FetchDocument returns a post document as docx
+	FetchDocument(document SourceFile) ([]byte, error)
+	// FetchImage returns an image
+	FetchImage(image SourceFile) ([]byte, error)
+	// Watch subscribes to changes of a post document. Notifications carry the returned channel's ID.
+	Watch(document SourceFile) (*Channel, error)
+	// StopWatch ends a subscription made with Watch
+	StopWatch(channel *Channel) error
+}
+
+var (
+	_ Source = (*driveSource)(nil)
+	_ Source = (*localSource)(nil)
+	_ Source = (*memorySource)(nil)
+)
+
+// ChangeFeed is a Source that reports every change in its tree, in order, like the Drive changes feed. Page tokens
+// are positions in the feed.
+type ChangeFeed interface {
+	Source
+	// RootFolderID returns the ID of the folder that holds every author's folder
+	RootFolderID() (string, error)
+	// StartPageToken returns the position of the next change
+	StartPageToken() (string, error)
+	// ListChanges returns a page of changes from pageToken on, including removed files
+	ListChanges(pageToken string) (*ChangePage, error)
+	// GetFolder returns a folder, with its parents
+	GetFolder(id string) (*FeedFile, error)
+	// WatchChanges subscribes to changes from pageToken on. The channel is stopped with StopWatch.
+	WatchChanges(pageToken string) (*Channel, error)
+}
+
+var (
+	_ ChangeFeed = (*driveSource)(nil)
+	_ ChangeFeed = (*memorySource)(nil)
+)
+
+// ChangePage is a page of a ChangeFeed. NextPageToken is empty on the last page, which sets NewStartPageToken instead.
+type ChangePage struct {
+	Changes           []FeedChange
+	NextPageToken     string
+	NewStartPageToken string
+}
+
+// FeedChange is a change to one file. File is nil if the file was removed.
+type FeedChange struct {
+	FileID  string
+	Removed bool
+	File    *FeedFile
+}
+
+// FeedFile is a file or folder as a ChangeFeed reports it
+type FeedFile struct {
+	SourceFile
+	Parents []string
+	Trashed bool
+}
+
+// SourceFile is a file or folder in a Source
+type SourceFile struct {
+	ID            string
+	Name          string
+	MimeType      string
+	FileExtension string
+	Checksum      string // changes whenever the file's content does; empty for folders
+	Cover         bool   // marked as its post's cover image, with the Drive file property cover=true
+}
+
+const (
+	coverName     = "cover" // an image named cover, with any extension, is its post's cover unless another is marked
+	coverProperty = "cover" // the Drive file property that marks an image as its post's cover
+)
+
+// selectCover picks a post's cover image from the images in its folder and returns it along with the rest, sorted by
+// name. An image marked with the cover property is chosen first, then one named cover, then the first by name.
+func selectCover(images []SourceFile) (SourceFile, []SourceFile) {
+	sorted := append([]SourceFile(nil), images...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	cover := -1
+	for i, image := range sorted {
+		if image.Cover {
+			cover = i
+			break
+		}
+	}
+	for i, image := range sorted {
+		if cover >= 0 {
+			break
+		}
+		if strings.EqualFold(strings.TrimSuffix(image.Name, path.Ext(image.Name)), coverName) {
+			cover = i
+		}
+	}
+	if cover < 0 {
+		cover = 0
+	}
+
+	gallery := append(append([]SourceFile{}, sorted[:cover]...), sorted[cover+1:]...)
+	return sorted[cover], gallery
+}
+
+// Channel is a subscription to changes of a post document
+type Channel struct {
+	ID         string
+	ResourceID string    // the source's own ID for the watched resource
+	Token      string    `json:"-"` // secret sent back with every notification; empty if notifications aren't sent over http
+	Expiration time.Time // the zero time if the channel never expires
+}
+
+// verify reports whether a webhook notification's token and resource ID match the channel. Channels without a
+// token never match.
+func (c *Channel) verify(token string, resourceID string) bool {
+	return c.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 &&
+		resourceID == c.ResourceID
+}
+
+// expiresBefore reports whether the channel stops delivering notifications before t
+func (c *Channel) expiresBefore(t time.Time) bool {
+	return !c.Expiration.IsZero() && c.Expiration.Before(t)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// buildResult is how a post's build, or a publish of the site, went. Once finished it isn't changed again.
+type buildResult struct {
+	Kind     string      `json:"kind"`
+	Status   string      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Duration string      `json:"duration"`
+	Steps    []buildStep `json:"steps,omitempty"`
+
+	steps *buildSteps
+}
+
+// buildStep is one step of a build. Steps that run a command keep its output.
+type buildStep struct {
+	Name     string    `json:"name"`
+	Command  string    `json:"command,omitempty"`
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+	Stdout   string    `json:"stdout,omitempty"`
+	Stderr   string    `json:"stderr,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// buildSteps collects the steps of a running build. A nil buildSteps records nothing.
+type buildSteps struct {
+	lock  sync.Mutex
+	steps []buildStep
+}
+
+func newBuildResult(kind string) *buildResult {
+	return &buildResult{
+		Kind:    kind,
+		Started: time.Now(),
+		steps:   new(buildSteps),
+	}
+}
+
+// finish records the build's outcome and the steps it ran
+func (b *buildResult) finish(err error) *buildResult {
+	b.Finished = time.Now()
+	b.Duration = b.Finished.Sub(b.Started).String()
+	b.Status = jobSucceeded
+	if err != nil {
+		b.Status = jobFailed
+		b.Error = err.Error()
+	}
+	b.Steps = b.steps.list()
+	return b
+}
+
+// summary returns the result without its steps
+func (b *buildResult) summary() *buildResult {
+	if b == nil {
+		return nil
+	}
+	summary := *b
+	summary.Steps = nil
+	return &summary
+}
+
+// step records a step that doesn't run a command
+func (s *buildSteps) step(name string, started time.Time, err error) {
+	s.add(buildStep{Name: name, Started: started}, err)
+}
+
+// command runs cmd as a step, returning the stdout and stderr it captured
+func (s *buildSteps) command(name string, cmd *exec.Cmd) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	started := time.Now()
+	err := cmd.Run()
+	s.add(buildStep{
+		Name:    name,
+		Command: strings.Join(cmd.Args, " "),
+		Started: started,
+		Stdout:  stdout.String(),
+		Stderr:  stderr.String(),
+	}, err)
+	return stdout.String(), stderr.String(), err
+}
+
+func (s *buildSteps) add(step buildStep, err error) {
+	if s == nil {
+		return
+	}
+	step.Duration = time.Since(step.Started).String()
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.steps = append(s.steps, step)
+}
+
+func (s *buildSteps) list() []buildStep {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]buildStep(nil), s.steps...)
+}
+
+/*************
+* status API *
+*************/
+
+// postStatus is what the daemon knows about a post
+type postStatus struct {
+	Author            string       `json:"author"`
+	Date              string       `json:"date"`
+	FileName          string       `json:"fileName"`
+	MimeType          string       `json:"mimeType"`
+	Image             string       `json:"image"`
+	Gallery           []string     `json:"gallery,omitempty"`
+	ChannelExpiration *time.Time   `json:"channelExpiration,omitempty"`
+	LastUpdated       *time.Time   `json:"lastUpdated,omitempty"`
+	LastBuild         *buildResult `json:"lastBuild,omitempty"`
+	LastPublish       *buildResult `json:"lastPublish,omitempty"` // of the whole site; only in a single post's status
+}
+
+// newPostStatus describes a snapshot of the post
+func newPostStatus(post Post) postStatus {
+	status := postStatus{
+		Author:    post.Author,
+		Date:      post.Date,
+		FileName:  post.FileName,
+		MimeType:  post.MimeType,
+		Image:     post.image.Name,
+		LastBuild: post.lastBuild,
+	}
+	for _, image := range post.gallery {
+		status.Gallery = append(status.Gallery, image.Name)
+	}
+	if post.Channel != nil && !post.Channel.Expiration.IsZero() {
+		expiration := post.Channel.Expiration
+		status.ChannelExpiration = &expiration
+	}
+	if !post.LastUpdated.IsZero() {
+		lastUpdated := post.LastUpdated
+		status.LastUpdated = &lastUpdated
+	}
+	return status
+}
+
+// HandlePosts lists every post, newest first, with its last build but not the build's steps
+func HandlePosts(posts *PostRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshots := posts.snapshots()
+		statuses := make([]postStatus, 0, len(snapshots))
+		for _, post := range snapshots {
+			status := newPostStatus(post)
+			status.LastBuild = status.LastBuild.summary()
+			statuses = append(statuses, status)
+		}
+
+		sort.Slice(statuses, func(i, j int) bool {
+			if statuses[i].Date != statuses[j].Date {
+				return statuses[i].Date > statuses[j].Date
+			}
+			return statuses[i].Author < statuses[j].Author
+		})
+		writeJSON(w, statuses)
+	}
+}
+
+// HandlePost describes one post, with the output of each step of its last build and of the last site publish
+func HandlePost(posts *PostRegistry, site *sitePublisher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		post := posts.find(vars["author"], vars["date"])
+		if post == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		status := newPostStatus(posts.snapshot(post))
+		status.LastPublish = site.lastPublish()
+
+		writeJSON(w, status)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("Error writing response")
+	}
+}
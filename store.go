@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	postsBucket    = []byte("posts")
+	channelsBucket = []byte("channels")
+	buildsBucket   = []byte("builds")
+)
+
+// stateStore keeps what is known about each post in a bbolt file, so a restart can reuse the posts' watch channels
+// and skip rebuilding posts that haven't changed. Records are keyed by the post's folder ID. A nil store keeps
+// nothing.
+type stateStore struct {
+	db *bolt.DB
+}
+
+// postRecord is the saved form of a Post
+type postRecord struct {
+	Author        string       `json:"author"`
+	Date          string       `json:"date"`
+	FolderID      string       `json:"folderId"`
+	FileName      string       `json:"fileName"`
+	FileExtension string       `json:"fileExtension"`
+	FileID        string       `json:"fileId"`
+	MimeType      string       `json:"mimeType"`
+	Checksum      string       `json:"checksum"`
+	Image         SourceFile   `json:"image"`
+	Gallery       []SourceFile `json:"gallery,omitempty"`
+	LastUpdated   time.Time    `json:"lastUpdated"`
+}
+
+// channelRecord is the saved form of a Channel, token included
+type channelRecord struct {
+	ID         string    `json:"id"`
+	ResourceID string    `json:"resourceId"`
+	Token      string    `json:"token"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// buildRecord is the result of a post's last build, and the files it was built from
+type buildRecord struct {
+	Kind            string    `json:"kind"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	Checksum        string    `json:"checksum"`
+	ImageChecksum   string    `json:"imageChecksum"`
+	GalleryChecksum string    `json:"galleryChecksum,omitempty"`
+	PostPath        string    `json:"postPath"`
+	ImagePath       string    `json:"imagePath"`
+}
+
+// storedPost is everything saved for one post. channel and build are nil if none was saved.
+type storedPost struct {
+	post    postRecord
+	channel *channelRecord
+	build   *buildRecord
+}
+
+// openStateStore opens the state file, creating it if needed. An empty path returns a nil store.
+func openStateStore(path string) (*stateStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening state file '%s': %s", path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{postsBucket, channelsBucket, buildsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error initializing state file '%s': %s", path, err.Error())
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// load returns every saved post by folder ID
+func (s *stateStore) load() (map[string]*storedPost, error) {
+	saved := make(map[string]*storedPost)
+	if s == nil {
+		return saved, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(postsBucket).ForEach(func(k, v []byte) error {
+			stored := new(storedPost)
+			if err := json.Unmarshal(v, &stored.post); err != nil {
+				return fmt.Errorf("post '%s': %s", k, err.Error())
+			}
+			saved[string(k)] = stored
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(channelsBucket).ForEach(func(k, v []byte) error {
+			stored, ok := saved[string(k)]
+			if !ok {
+				return nil
+			}
+			stored.channel = new(channelRecord)
+			if err := json.Unmarshal(v, stored.channel); err != nil {
+				return fmt.Errorf("channel of post '%s': %s", k, err.Error())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(buildsBucket).ForEach(func(k, v []byte) error {
+			stored, ok := saved[string(k)]
+			if !ok {
+				return nil
+			}
+			stored.build = new(buildRecord)
+			if err := json.Unmarshal(v, stored.build); err != nil {
+				return fmt.Errorf("build of post '%s': %s", k, err.Error())
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error loading saved state: %s", err.Error())
+	}
+	return saved, nil
+}
+
+// savePost saves the post's files. Callers hold the post's lock, or haven't shared the post yet.
+func (s *stateStore) savePost(post *Post) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx, postsBucket, post.FolderID, newPostRecord(post))
+	})
+}
+
+// saveChannel saves the channel watching a post's document. A nil channel removes the saved one.
+func (s *stateStore) saveChannel(folderID string, channel *Channel) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if channel == nil {
+			return tx.Bucket(channelsBucket).Delete([]byte(folderID))
+		}
+		return putRecord(tx, channelsBucket, folderID, channelRecord{
+			ID:         channel.ID,
+			ResourceID: channel.ResourceID,
+			Token:      channel.Token,
+			Expiration: channel.Expiration,
+		})
+	})
+}
+
+// saveBuild saves a snapshot of the post's files along with the result of building it, without the build's steps
+func (s *stateStore) saveBuild(post *Post, result *buildResult) error {
+	if s == nil {
+		return nil
+	}
+
+	build := buildRecord{
+		Kind:            result.Kind,
+		Status:          result.Status,
+		Error:           result.Error,
+		Started:         result.Started,
+		Finished:        result.Finished,
+		Checksum:        post.checksum,
+		ImageChecksum:   post.image.Checksum,
+		GalleryChecksum: galleryChecksum(post.gallery),
+		PostPath:        post.postPath,
+		ImagePath:       post.imagePath,
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := putRecord(tx, postsBucket, post.FolderID, newPostRecord(post)); err != nil {
+			return err
+		}
+		return putRecord(tx, buildsBucket, post.FolderID, build)
+	})
+}
+
+// removePost forgets everything saved for a post
+func (s *stateStore) removePost(folderID string) error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{postsBucket, channelsBucket, buildsBucket} {
+			if err := tx.Bucket(bucket).Delete([]byte(folderID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putRecord(tx *bolt.Tx, bucket []byte, key string, record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), b)
+}
+
+func newPostRecord(post *Post) postRecord {
+	return postRecord{
+		Author:        post.Author,
+		Date:          post.Date,
+		FolderID:      post.FolderID,
+		FileName:      post.FileName,
+		FileExtension: post.FileExtension,
+		FileID:        post.FileID,
+		MimeType:      post.MimeType,
+		Checksum:      post.checksum,
+		Image:         post.image,
+		Gallery:       post.gallery,
+		LastUpdated:   post.LastUpdated,
+	}
+}
+
+// galleryChecksum changes whenever an image is added to or removed from the gallery, or one's content changes. It's
+// empty for a post without a gallery.
+func galleryChecksum(gallery []SourceFile) string {
+	if len(gallery) == 0 {
+		return ""
+	}
+	h := md5.New()
+	for _, image := range gallery {
+		fmt.Fprintf(h, "%s\x00%s\n", image.Name, image.Checksum)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+/*************************************
+* resume posts saved by the last run *
+*************************************/
+
+// resumeChannel returns the saved channel if it still watches the post's document and hasn't expired. Channels only
+// outlive the program when the source is Drive.
+func (stored *storedPost) resumeChannel(cfg *Config, post *Post) *Channel {
+	channel := stored.savedChannel()
+	if channel == nil || cfg.Source != sourceDrive || cfg.Drive.WatchMode != watchModeFiles {
+		return nil
+	}
+	if stored.post.FileID != post.FileID || channel.expiresBefore(time.Now()) {
+		return nil
+	}
+	return channel
+}
+
+// upToDate reports whether the post's last build succeeded from the same document and images the source has now, and
+// the downloaded files and html from that build are still in place
+func (stored *storedPost) upToDate(cfg *Config, post *Post) bool {
+	if stored == nil || stored.build == nil || stored.build.Status != jobSucceeded {
+		return false
+	}
+	build := stored.build
+	if post.checksum == "" || build.Checksum != post.checksum || build.ImageChecksum != post.image.Checksum ||
+		build.GalleryChecksum != galleryChecksum(post.gallery) {
+		return false
+	}
+	paths := []string{build.PostPath, build.ImagePath, cfg.postHTMLDir(post)}
+	for _, image := range post.gallery {
+		paths = append(paths, downloadedImagePath(cfg.postDownloadDir(post), image))
+	}
+	for _, path := range paths {
+		if exists, err := pathExists(path); err != nil || !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// lastBuild returns the saved result of the post's last build, which has no steps, or nil if there is none
+func (stored *storedPost) lastBuild() *buildResult {
+	if stored == nil || stored.build == nil {
+		return nil
+	}
+	build := stored.build
+	result := &buildResult{
+		Kind:     build.Kind,
+		Status:   build.Status,
+		Error:    build.Error,
+		Started:  build.Started,
+		Finished: build.Finished,
+	}
+	if !build.Started.IsZero() {
+		result.Duration = build.Finished.Sub(build.Started).String()
+	}
+	return result
+}
+
+// savedChannel returns the saved channel, or nil if there is none
+func (stored *storedPost) savedChannel() *Channel {
+	if stored == nil || stored.channel == nil {
+		return nil
+	}
+	return &Channel{
+		ID:         stored.channel.ID,
+		ResourceID: stored.channel.ResourceID,
+		Token:      stored.channel.Token,
+		Expiration: stored.channel.Expiration,
+	}
+}
+
+// stopSavedChannel stops the saved channel of a post that won't reuse it, unless it has expired already
+func stopSavedChannel(src Source, stored *storedPost) {
+	channel := stored.savedChannel()
+	if channel == nil || channel.expiresBefore(time.Now()) {
+		return
+	}
+	if err := src.StopWatch(channel); err != nil {
+		// it expires on its own eventually, and notifications to it are ignored until then
+		logrus.WithError(err).WithField("channel id", channel.ID).Warn("Error stopping channel saved by the last run")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // register the gif and png decoders for cover images
+	"image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp" // register the webp decoder for cover images
+)
+
+const (
+	thumbnailerNative = "native"
+	thumbnailerScript = "script"
+)
+
+// thumbnailSize is one thumbnail generated from each cover image, saved as <name>.jpg in the post's html directory
+type thumbnailSize struct {
+	Name   string `yaml:"name"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+}
+
+// makeThumbnails creates the thumbnails for a post's cover image. The native generator falls back to the thumbnail
+// script, if one is configured, when it fails.
+func makeThumbnails(cfg *Config, post Post, htmlDirectory string, steps *buildSteps, log *logrus.Entry) error {
+	defer observeStage(stageThumbnail, time.Now())
+
+	if cfg.Thumbnail.Generator == thumbnailerNative {
+		started := time.Now()
+		err := makeThumbnailsNative(cfg, post, htmlDirectory, log)
+		steps.step(stageThumbnail, started, err)
+		if err == nil || cfg.Scripts.Thumbnail == "" {
+			return err
+		}
+		log.WithError(err).Warn("Native thumbnail generation failed, falling back to thumbnail script")
+	}
+
+	return makeThumbnailsScript(cfg, post, htmlDirectory, steps, log)
+}
+
+func makeThumbnailsNative(cfg *Config, post Post, htmlDirectory string, log *logrus.Entry) error {
+	log.WithField("imagePath", post.imagePath).Info("Creating thumbnails from cover image")
+
+	cover, format, err := loadCover(post.imagePath)
+	if err != nil {
+		log.WithError(err).Error("Error loading cover image")
+		return err
+	}
+
+	for _, size := range cfg.Thumbnail.Sizes {
+		var title, author string
+		if cfg.Thumbnail.Overlay {
+			title, author = postTitle(post), post.Author
+		}
+
+		thumbnail, err := renderThumbnail(cover, size, title, author)
+		if err != nil {
+			log.WithError(err).WithField("size", size.Name).Error("Error rendering thumbnail")
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: cfg.Thumbnail.Quality}); err != nil {
+			log.WithError(err).WithField("size", size.Name).Error("Error encoding thumbnail")
+			return err
+		}
+
+		thumbnailPath := filepath.Join(htmlDirectory, size.Name+".jpg")
+		if err := ioutil.WriteFile(thumbnailPath, buf.Bytes(), 0664); err != nil {
+			log.WithError(err).WithField("thumbnailPath", thumbnailPath).Error("Error saving thumbnail")
+			return err
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"format": format,
+		"sizes":  len(cfg.Thumbnail.Sizes),
+	}).Debug("Successfully created thumbnails from cover image")
+	return nil
+}
+
+func makeThumbnailsScript(cfg *Config, post Post, htmlDirectory string, steps *buildSteps, log *logrus.Entry) error {
+	var args []string
+	args = append(args, cfg.Scripts.Thumbnail, postTitle(post), post.Author, post.imagePath, htmlDirectory)
+
+	log.WithField("cmd", strings.Join(args, " ")).Info("Running script to create thumbnails from cover image")
+
+	stdout, stderr, err := steps.command("thumbnail script", exec.Command(args[0], args[1:]...))
+	if err != nil {
+		log.WithError(err).WithField("stderr", stderr).Error("Failed to run script to create thumbnails from cover image")
+		return err
+	}
+
+	log.WithField("stdout", stdout).Debug("Successfully ran script to create thumbnails from cover image")
+	return nil
+}
+
+// loadCover decodes a cover image, turning jpegs upright as their EXIF orientation says, as phones save them
+// sideways and leave the turning to whatever shows them
+func loadCover(imagePath string) (image.Image, string, error) {
+	b, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading cover image: %s", err.Error())
+	}
+
+	cover, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", fmt.Errorf("Error decoding cover image: %s", err.Error())
+	}
+	if format == "jpeg" {
+		cover = orientImage(cover, exifOrientation(b))
+	}
+	return cover, format, nil
+}
+
+/**********************
+* thumbnail rendering *
+**********************/
+
+// renderThumbnail scales the cover image to fill the thumbnail size, cropping whatever overflows evenly from both
+// sides. If a title is given it's written over the bottom of the thumbnail, along with the author.
+func renderThumbnail(cover image.Image, size thumbnailSize, title string, author string) (image.Image, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), cover, cropToAspect(cover.Bounds(), size.Width, size.Height), draw.Src, nil)
+
+	if title != "" {
+		if err := drawOverlay(dst, title, author); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// cropToAspect returns the largest centered rectangle inside bounds with the aspect ratio width:height
+func cropToAspect(bounds image.Rectangle, width int, height int) image.Rectangle {
+	w, h := bounds.Dx(), bounds.Dy()
+	if w*height > h*width { // too wide, crop the sides
+		cropped := h * width / height
+		x := bounds.Min.X + (w-cropped)/2
+		return image.Rect(x, bounds.Min.Y, x+cropped, bounds.Max.Y)
+	}
+
+	cropped := w * height / width // too tall, crop the top and bottom
+	y := bounds.Min.Y + (h-cropped)/2
+	return image.Rect(bounds.Min.X, y, bounds.Max.X, y+cropped)
+}
+
+// drawOverlay darkens the bottom of the image and writes the title and author over it in white
+func drawOverlay(dst *image.RGBA, title string, author string) error {
+	bounds := dst.Bounds()
+	titleSize := float64(bounds.Dy()) / 10
+	authorSize := titleSize * 0.6
+	padding := int(titleSize / 2)
+
+	titleFace, err := loadFace(gobold.TTF, titleSize)
+	if err != nil {
+		return err
+	}
+	defer titleFace.Close()
+	authorFace, err := loadFace(goregular.TTF, authorSize)
+	if err != nil {
+		return err
+	}
+	defer authorFace.Close()
+
+	bandHeight := int(titleSize+authorSize) + 3*padding
+	band := image.Rect(bounds.Min.X, bounds.Max.Y-bandHeight, bounds.Max.X, bounds.Max.Y)
+	draw.Draw(dst, band, image.NewUniform(color.NRGBA{A: 140}), image.Point{}, draw.Over)
+
+	maxWidth := fixed.I(bounds.Dx() - 2*padding)
+	authorBaseline := bounds.Max.Y - padding
+	titleBaseline := authorBaseline - int(authorSize) - padding
+	drawText(dst, titleFace, fitText(titleFace, title, maxWidth), bounds.Min.X+padding, titleBaseline)
+	drawText(dst, authorFace, fitText(authorFace, author, maxWidth), bounds.Min.X+padding, authorBaseline)
+	return nil
+}
+
+func loadFace(ttf []byte, size float64) (font.Face, error) {
+	parsed, err := opentype.Parse(ttf)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing font: %s", err.Error())
+	}
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating font face: %s", err.Error())
+	}
+	return face, nil
+}
+
+// fitText shortens text with an ellipsis until it is no wider than maxWidth
+func fitText(face font.Face, text string, maxWidth fixed.Int26_6) string {
+	if font.MeasureString(face, text) <= maxWidth {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		shortened := strings.TrimSpace(string(runes)) + "…"
+		if font.MeasureString(face, shortened) <= maxWidth {
+			return shortened
+		}
+	}
+	return ""
+}
+
+func drawText(dst *image.RGBA, face font.Face, text string, x int, baseline int) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(x, baseline),
+	}
+	d.DrawString(text)
+}
+
+/*******************
+* exif orientation *
+*******************/
+
+// exifOrientation returns the orientation tag (1-8) of a jpeg's EXIF data, or 1, meaning upright, if it has none
+func exifOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+
+	// walk the segments before the image data, looking for the APP1 segment holding EXIF
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(b) { // start of scan, or a broken segment
+			return 1
+		}
+		segment := b[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of EXIF's TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < entries; e++ {
+		entry := ifd + 2 + 12*e
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // orientation, a SHORT stored in the value field
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientImage turns an image upright given its EXIF orientation: 2-4 mirror or turn it over, 5-8 also swap its
+// width and height
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// source returns the pixel of img that ends up at x, y of the upright image
+	source := func(x, y int) (int, int) {
+		switch orientation {
+		case 2: // mirrored
+			return w - 1 - x, y
+		case 3: // upside down
+			return w - 1 - x, h - 1 - y
+		case 4: // mirrored upside down
+			return x, h - 1 - y
+		case 5: // mirrored, turned counterclockwise
+			return y, x
+		case 6: // turned counterclockwise, needs turning clockwise
+			return y, h - 1 - x
+		case 7: // mirrored, turned clockwise
+			return w - 1 - y, h - 1 - x
+		default: // 8: turned clockwise, needs turning counterclockwise
+			return w - 1 - y, x
+		}
+	}
+
+	upright := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := source(x, y)
+			upright.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return upright
+}
+
+/**************
+* heic images *
+**************/
+
+// convertHEIC converts a downloaded HEIC or HEIF image to jpeg with scripts.heic, run as `<script> <image> <jpeg>`.
+// Thumbnails are made from the jpeg, and it's what a gallery publishes.
+func convertHEIC(cfg *Config, imagePath string, jpegPath string, steps *buildSteps, log *logrus.Entry) error {
+	args := []string{cfg.Scripts.HEIC, imagePath, jpegPath}
+
+	log.WithField("cmd", strings.Join(args, " ")).Info("Running script to convert image to jpeg")
+
+	stdout, stderr, err := steps.command("heic script", exec.Command(args[0], args[1:]...))
+	if err != nil {
+		log.WithError(err).WithField("stderr", stderr).Error("Failed to run script to convert image to jpeg")
+		return fmt.Errorf("Error converting image to jpeg: %s", err.Error())
+	}
+
+	log.WithField("stdout", stdout).Debug("Successfully ran script to convert image to jpeg")
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden thumbnails in testdata/thumbnail/golden")
+
+// the fixture covers are split into red, green, blue and yellow quarters, with a white stripe down the left edge
+func TestRenderThumbnailGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		cover  string
+		size   thumbnailSize
+		title  string
+		author string
+	}{
+		{name: "crop-sides", cover: "wide.png", size: thumbnailSize{Name: "thumbnail", Width: 30, Height: 20}},
+		{name: "crop-top-bottom", cover: "tall.png", size: thumbnailSize{Name: "thumbnail", Width: 30, Height: 20}},
+		{name: "no-crop", cover: "wide.png", size: thumbnailSize{Name: "banner", Width: 60, Height: 20}},
+		{name: "exif-orientation", cover: "sideways.jpg", size: thumbnailSize{Name: "thumbnail", Width: 20, Height: 30}},
+		{
+			name:   "overlay",
+			cover:  "wide.png",
+			size:   thumbnailSize{Name: "thumbnail", Width: 240, Height: 160},
+			title:  "A Post With A Title Far Too Long To Fit On One Line",
+			author: "alice",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			cover, _, err := loadCover(filepath.Join("testdata", "thumbnail", test.cover))
+			if err != nil {
+				t.Fatal(err)
+			}
+			thumbnail, err := renderThumbnail(cover, test.size, test.title, test.author)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "thumbnail", "golden", test.name+".png")
+			if *updateGolden {
+				writeTestPNG(t, golden, thumbnail)
+				return
+			}
+			compareImages(t, readTestPNG(t, golden), thumbnail)
+		})
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	sideways, err := ioutil.ReadFile(filepath.Join("testdata", "thumbnail", "sideways.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orientation := exifOrientation(sideways); orientation != 6 {
+		t.Errorf("sideways.jpg orientation = %d, want 6", orientation)
+	}
+
+	wide, err := ioutil.ReadFile(filepath.Join("testdata", "thumbnail", "wide.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orientation := exifOrientation(wide); orientation != 1 {
+		t.Errorf("png orientation = %d, want 1", orientation)
+	}
+	if orientation := exifOrientation([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF}); orientation != 1 {
+		t.Errorf("truncated jpeg orientation = %d, want 1", orientation)
+	}
+}
+
+func TestUprightJPEG(t *testing.T) {
+	sideways, err := ioutil.ReadFile(filepath.Join("testdata", "thumbnail", "sideways.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := image.DecodeConfig(bytes.NewReader(sideways))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := uprightJPEG(sideways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upright, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || upright.Width != stored.Height || upright.Height != stored.Width {
+		t.Errorf("upright image is a %dx%d %s, want a %dx%d jpeg", upright.Width, upright.Height, format, stored.Height, stored.Width)
+	}
+	if orientation := exifOrientation(b); orientation != 1 {
+		t.Errorf("upright image still has orientation %d", orientation)
+	}
+
+	wide, err := ioutil.ReadFile(filepath.Join("testdata", "thumbnail", "wide.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := uprightJPEG(wide); err != nil || !bytes.Equal(b, wide) {
+		t.Errorf("png was changed: %v", err)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// a 3x2 image whose pixels are labelled a-f, row by row
+	stored := []string{
+		"abc",
+		"def",
+	}
+	tests := []struct {
+		orientation int
+		upright     []string
+	}{
+		{1, []string{"abc", "def"}},
+		{2, []string{"cba", "fed"}},
+		{3, []string{"fed", "cba"}},
+		{4, []string{"def", "abc"}},
+		{5, []string{"ad", "be", "cf"}},
+		{6, []string{"da", "eb", "fc"}},
+		{7, []string{"fc", "eb", "da"}},
+		{8, []string{"cf", "be", "ad"}},
+	}
+
+	for _, test := range tests {
+		got := gridLabels(orientImage(labelledGrid(stored), test.orientation))
+		if !equalRows(got, test.upright) {
+			t.Errorf("orientation %d: got %v, want %v", test.orientation, got, test.upright)
+		}
+	}
+}
+
+// labelledGrid makes an image whose pixels' red values are the labels in rows
+func labelledGrid(rows []string) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, label := range []byte(row) {
+			img.Set(x, y, color.RGBA{R: label, A: 255})
+		}
+	}
+	return img
+}
+
+func gridLabels(img image.Image) []string {
+	b := img.Bounds()
+	var rows []string
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var row []byte
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			row = append(row, byte(r>>8))
+		}
+		rows = append(rows, string(row))
+	}
+	return rows
+}
+
+func equalRows(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// compareImages fails the test if the images differ in size, or any channel of any pixel differs by more than a
+// little, leaving room for rounding in the scaler
+func compareImages(t *testing.T, want image.Image, got image.Image) {
+	t.Helper()
+
+	if want.Bounds().Size() != got.Bounds().Size() {
+		t.Fatalf("size = %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	const tolerance = 2 << 8
+	wb, gb := want.Bounds(), got.Bounds()
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			wr, wg, wbl, wa := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			gr, gg, gbl, ga := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			if diff(wr, gr) > tolerance || diff(wg, gg) > tolerance || diff(wbl, gbl) > tolerance || diff(wa, ga) > tolerance {
+				t.Fatalf("pixel (%d, %d) = %v, want %v; rerun with -update if the change is intended",
+					x, y, got.At(gb.Min.X+x, gb.Min.Y+y), want.At(wb.Min.X+x, wb.Min.Y+y))
+			}
+		}
+	}
+}
+
+func diff(a uint32, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func readTestPNG(t *testing.T, path string) image.Image {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func writeTestPNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
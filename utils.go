@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -11,20 +13,38 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/drive/v3"
-)
-
-var (
-	driveService *drive.Service
-	driveClient  *http.Client
 )
 
 const (
 	docxMime      string = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
 	googleDocMime string = "application/vnd.google-apps.document"
 	jpegMime      string = "image/jpeg"
+	pngMime       string = "image/png"
+	webpMime      string = "image/webp"
+	gifMime       string = "image/gif"
+	heicMime      string = "image/heic"
+	heifMime      string = "image/heif"
+	folderMime    string = "application/vnd.google-apps.folder"
 )
 
+// imageMimes are the mime types a post image may have
+var imageMimes = []string{jpegMime, pngMime, webpMime, gifMime, heicMime, heifMime}
+
+func isImageMime(mimeType string) bool {
+	for _, m := range imageMimes {
+		if mimeType == m {
+			return true
+		}
+	}
+	return false
+}
+
+// isHEICMime reports whether an image is HEIC or HEIF, as phones take them, which is converted to jpeg after
+// it's downloaded since it can't be decoded natively
+func isHEICMime(mimeType string) bool {
+	return mimeType == heicMime || mimeType == heifMime
+}
+
 type driveFileGetError struct {
 	Error struct {
 		Code    int           `json:"code"`
@@ -33,9 +53,14 @@ type driveFileGetError struct {
 	} `json:"error"`
 }
 
+// math/rand is seeded once, so IDs generated in the same instant still differ
+func init() {
+	rand.Seed(time.Now().UTC().UnixNano())
+}
+
+// generateHash returns a random alphanumeric ID. It isn't secret; use generateToken for that.
 func generateHash(length int) string {
 	pool := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	rand.Seed(time.Now().UTC().UnixNano())
 	b := make([]rune, length)
 	for i := range b {
 		b[i] = pool[rand.Intn(len(pool))]
@@ -43,6 +68,15 @@ func generateHash(length int) string {
 	return string(b)
 }
 
+// generateToken returns a random secret for a watch channel, which Drive sends back with each notification
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", fmt.Errorf("Error generating channel token: %s", err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // exists returns whether the given file or directory exists
 func pathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -60,11 +94,10 @@ func pathExists(path string) (bool, error) {
 *****************************/
 
 // Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
+func getClient(config *oauth2.Config, tokFile string) *http.Client {
+	// The token file stores the user's access and refresh tokens, and is
 	// created automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "/home/grish/update-posts/token.json"
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
 		tok = getTokenFromWeb(config)